@@ -0,0 +1,156 @@
+package arrival
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Process decides the gaps between requests. Every Process keeps the mean
+// gap it is asked for, so the mean request rate is preserved.
+type Process interface {
+	// Gap returns the time until the next request for the given mean gap.
+	Gap(mean time.Duration) time.Duration
+}
+
+// Uniform is a Process that spaces requests perfectly evenly.
+type Uniform struct{}
+
+// Gap returns the mean gap.
+func (Uniform) Gap(mean time.Duration) time.Duration {
+	return mean
+}
+
+// Poisson is a Process with exponentially distributed gaps, as when
+// requests come from many independent clients.
+type Poisson struct{}
+
+// Gap returns an exponentially distributed gap.
+func (Poisson) Gap(mean time.Duration) time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(mean))
+}
+
+// Jitter is a Process whose gaps are spread uniformly within Fraction of
+// the mean either side of it.
+type Jitter struct {
+	Fraction float64
+}
+
+// Gap returns a gap within Fraction of the mean.
+func (j Jitter) Gap(mean time.Duration) time.Duration {
+	return time.Duration(float64(mean) * (1 + j.Fraction*(2*rand.Float64()-1)))
+}
+
+// Empirical is a Process whose gaps are drawn from a set of samples, scaled
+// so that their mean is the mean asked for.
+type Empirical struct {
+	// Scales holds each sample divided by the mean of all samples.
+	Scales []float64
+}
+
+// NewEmpirical builds an Empirical from samples in any unit.
+func NewEmpirical(samples []float64) (Empirical, error) {
+	if len(samples) == 0 {
+		return Empirical{}, fmt.Errorf("no samples")
+	}
+	sum := 0.0
+	for _, s := range samples {
+		// A zero gap would send requests at the same instant.
+		if s <= 0 {
+			return Empirical{}, fmt.Errorf("sample %g must be positive", s)
+		}
+		sum += s
+	}
+	mean := sum / float64(len(samples))
+	scales := make([]float64, len(samples))
+	for i, s := range samples {
+		scales[i] = s / mean
+	}
+	return Empirical{Scales: scales}, nil
+}
+
+// Gap returns a randomly chosen sample scaled to the mean.
+func (e Empirical) Gap(mean time.Duration) time.Duration {
+	return time.Duration(e.Scales[rand.Intn(len(e.Scales))] * float64(mean))
+}
+
+// Parse builds a Process from its description. Supported descriptions are:
+//
+//	uniform          evenly spaced requests
+//	poisson          exponentially distributed gaps
+//	jitter:<f>       gaps spread uniformly within a fraction f of the mean
+//	@<path>          gaps drawn from a file of samples, '@-' reads stdin
+func Parse(spec string) (Process, error) {
+	if strings.HasPrefix(spec, "@") {
+		path := spec[1:]
+		if path == "-" {
+			return ReadEmpirical(os.Stdin)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ReadEmpirical(file)
+	}
+
+	parts := strings.Split(spec, ":")
+	switch parts[0] {
+	case "uniform":
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("uniform takes no parameters")
+		}
+		return Uniform{}, nil
+	case "poisson":
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("poisson takes no parameters")
+		}
+		return Poisson{}, nil
+	case "jitter":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("jitter should be jitter:<fraction>")
+		}
+		fraction, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || fraction < 0 || fraction > 1 {
+			return nil, fmt.Errorf("jitter fraction '%s' should be in the range of [0.0, 1.0]", parts[1])
+		}
+		return Jitter{Fraction: fraction}, nil
+	default:
+		return nil, fmt.Errorf("unknown arrival process '%s'", parts[0])
+	}
+}
+
+// ReadEmpirical reads one gap sample per line, either as a duration such
+// as "12ms" or as a plain number. Blank lines and lines starting with '#'
+// are ignored.
+func ReadEmpirical(r io.Reader) (Empirical, error) {
+	var samples []float64
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			d, derr := time.ParseDuration(line)
+			if derr != nil {
+				return Empirical{}, fmt.Errorf("invalid sample on line %d: '%s'", i, line)
+			}
+			sample = float64(d)
+		}
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return Empirical{}, err
+	}
+	if len(samples) == 0 {
+		return Empirical{}, fmt.Errorf("no samples found")
+	}
+	return NewEmpirical(samples)
+}
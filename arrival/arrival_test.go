@@ -0,0 +1,99 @@
+package arrival
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ArrivalTestSuite struct{}
+
+var _ = Suite(&ArrivalTestSuite{})
+
+// meanGap returns the mean of many gaps drawn from p.
+func meanGap(p Process, mean time.Duration) time.Duration {
+	total := time.Duration(0)
+	n := 100000
+	for i := 0; i < n; i++ {
+		total += p.Gap(mean)
+	}
+	return total / time.Duration(n)
+}
+
+// near returns whether got is within 2% of expected.
+func near(got time.Duration, expected time.Duration) bool {
+	return math.Abs(float64(got-expected)) < 0.02*float64(expected)
+}
+
+func (*ArrivalTestSuite) TestUniform(c *C) {
+	c.Assert(Uniform{}.Gap(10*time.Millisecond), Equals, 10*time.Millisecond)
+}
+
+func (*ArrivalTestSuite) TestPoissonKeepsMean(c *C) {
+	c.Assert(near(meanGap(Poisson{}, 10*time.Millisecond), 10*time.Millisecond), Equals, true)
+}
+
+func (*ArrivalTestSuite) TestJitter(c *C) {
+	j := Jitter{Fraction: 0.5}
+	for i := 0; i < 1000; i++ {
+		gap := j.Gap(10 * time.Millisecond)
+		c.Assert(gap >= 5*time.Millisecond && gap <= 15*time.Millisecond, Equals, true)
+	}
+	c.Assert(near(meanGap(j, 10*time.Millisecond), 10*time.Millisecond), Equals, true)
+}
+
+func (*ArrivalTestSuite) TestEmpirical(c *C) {
+	e, err := NewEmpirical([]float64{1, 1, 4})
+	c.Assert(err, IsNil)
+	c.Assert(e.Scales, DeepEquals, []float64{0.5, 0.5, 2})
+	c.Assert(near(meanGap(e, 10*time.Millisecond), 10*time.Millisecond), Equals, true)
+
+	_, err = NewEmpirical(nil)
+	c.Assert(err, ErrorMatches, "no samples")
+	_, err = NewEmpirical([]float64{1, 0})
+	c.Assert(err, ErrorMatches, "sample 0 must be positive")
+	_, err = NewEmpirical([]float64{1, -1})
+	c.Assert(err, ErrorMatches, "sample -1 must be positive")
+}
+
+func (*ArrivalTestSuite) TestReadEmpirical(c *C) {
+	e, err := ReadEmpirical(strings.NewReader("# gaps\n5ms\n\n15ms\n"))
+	c.Assert(err, IsNil)
+	c.Assert(e.Scales, DeepEquals, []float64{0.5, 1.5})
+
+	e, err = ReadEmpirical(strings.NewReader("2\n6\n"))
+	c.Assert(err, IsNil)
+	c.Assert(e.Scales, DeepEquals, []float64{0.5, 1.5})
+
+	_, err = ReadEmpirical(strings.NewReader("soon\n"))
+	c.Assert(err, ErrorMatches, "invalid sample on line 1: 'soon'")
+	_, err = ReadEmpirical(strings.NewReader(""))
+	c.Assert(err, ErrorMatches, "no samples found")
+}
+
+func (*ArrivalTestSuite) TestParse(c *C) {
+	p, err := Parse("uniform")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Uniform{})
+
+	p, err = Parse("poisson")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Poisson{})
+
+	p, err = Parse("jitter:0.25")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Jitter{Fraction: 0.25})
+
+	_, err = Parse("jitter:2")
+	c.Assert(err, ErrorMatches, "jitter fraction '2' should be .*")
+	_, err = Parse("poisson:1")
+	c.Assert(err, ErrorMatches, "poisson takes no parameters")
+	_, err = Parse("bursty")
+	c.Assert(err, ErrorMatches, "unknown arrival process 'bursty'")
+}
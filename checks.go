@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// maxChecks is how many checks can be run on responses, so that the
+// checks a response failed fit in a bitmask.
+const maxChecks = 64
+
+// responseCheck is a check run on responses that succeeded, such as the
+// hash check or an assertion. Responses that fail it are still counted as
+// good or bad as usual, but their failure is reported separately. Every
+// check is either a bodyCheck or a streamingCheck.
+type responseCheck interface {
+	// name identifies the check in reports.
+	name() string
+	// applies returns true if the check should be run on a response from
+	// u. It is asked before the response body is read.
+	applies(u *url.URL) bool
+}
+
+// bodyCheck is a responseCheck that looks at the response once it has
+// been read.
+type bodyCheck interface {
+	responseCheck
+	needsBody() bool
+	passes(response *http.Response, body []byte) bool
+}
+
+// streamingCheck is a responseCheck that checks the body as it is read,
+// so that it doesn't need all of it in memory.
+type streamingCheck interface {
+	responseCheck
+	// stream returns a writer to copy the body of the response to request
+	// reqID from u to, and a function that returns whether the check
+	// passed once it has.
+	stream(u *url.URL, reqID uint64) (io.Writer, func() bool)
+}
+
+// assertion checks that responses match a rule, optionally only the
+// responses from urls matching scope.
+type assertion struct {
+	id    string
+	spec  string
+	scope *regexp.Regexp
+	rule  responseRule
+}
+
+// parseAssertion parses a rule, which may start with url:<regexp> to only
+// check the responses from matching urls. The url regexp ends at the
+// first comma.
+func parseAssertion(id string, spec string) (*assertion, error) {
+	a := &assertion{id: id, spec: spec}
+	ruleSpec := spec
+	if strings.HasPrefix(spec, "url:") {
+		parts := strings.SplitN(strings.TrimPrefix(spec, "url:"), ",", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid assertion %q, url:<regexp> should be followed by a rule", spec)
+		}
+		scope, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		a.scope = scope
+		ruleSpec = parts[1]
+	}
+	rule, err := parseResponseRule(ruleSpec)
+	if err != nil {
+		return nil, err
+	}
+	a.rule = rule
+	return a, nil
+}
+
+func (a *assertion) name() string {
+	return a.id
+}
+
+func (a *assertion) applies(u *url.URL) bool {
+	return a.scope == nil || a.scope.MatchString(u.String())
+}
+
+func (a *assertion) needsBody() bool {
+	return a.rule.needsBody()
+}
+
+func (a *assertion) passes(response *http.Response, body []byte) bool {
+	return a.rule.matches(response, body)
+}
+
+// assertions is a flag holding a list of assertions, which can be
+// repeated. They are named a1, a2 and so on in the order they're given.
+type assertions []*assertion
+
+func (a *assertions) String() string {
+	specs := make([]string, len(*a))
+	for i, assert := range *a {
+		specs[i] = assert.spec
+	}
+	return strings.Join(specs, " ")
+}
+
+func (a *assertions) Set(s string) error {
+	assert, err := parseAssertion(fmt.Sprintf("a%d", len(*a)+1), s)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, assert)
+	return nil
+}
+
+// responseChecks is everything done to judge a response: classifying it
+// as good or bad, and running the hash check and assertions on it. The
+// hash check, if any, comes first in checks.
+type responseChecks struct {
+	classify *classifier
+	checks   []responseCheck
+	hashed   bool
+}
+
+// newResponseChecks returns the checks to run on responses. hash may be
+// nil to not check hashes.
+func newResponseChecks(classify *classifier, hash *hashCheck, asserts assertions) (*responseChecks, error) {
+	c := &responseChecks{classify: classify}
+	if hash != nil {
+		c.checks = append(c.checks, hash)
+		c.hashed = true
+	}
+	for _, a := range asserts {
+		c.checks = append(c.checks, a)
+	}
+	if len(c.checks) > maxChecks {
+		return nil, fmt.Errorf("at most %d checks can be run", maxChecks)
+	}
+	return c, nil
+}
+
+// checkRun is the checks being run on one response.
+type checkRun struct {
+	checks *responseChecks
+	// applying is a bitmask of the checks that apply to the response.
+	applying uint64
+	// writers receive the body for the streaming checks, and streamed
+	// holds their results by index.
+	writers  []io.Writer
+	streamed map[int]func() bool
+}
+
+// start begins running the checks that apply to the response to request
+// reqID from u.
+func (c *responseChecks) start(u *url.URL, reqID uint64) *checkRun {
+	run := &checkRun{checks: c}
+	for i, check := range c.checks {
+		if !check.applies(u) {
+			continue
+		}
+		run.applying |= 1 << uint(i)
+		if s, ok := check.(streamingCheck); ok {
+			w, passed := s.stream(u, reqID)
+			run.writers = append(run.writers, w)
+			if run.streamed == nil {
+				run.streamed = make(map[int]func() bool)
+			}
+			run.streamed[i] = passed
+		}
+	}
+	return run
+}
+
+// needsBody returns true if the whole body is needed to judge the
+// response.
+func (r *checkRun) needsBody() bool {
+	if r.checks.classify.needsBody() {
+		return true
+	}
+	for i, check := range r.checks.checks {
+		if b, ok := check.(bodyCheck); ok && r.applying&(1<<uint(i)) != 0 && b.needsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyWriter returns the writer the response body should be copied to as
+// it is read, or nil if no check streams it.
+func (r *checkRun) bodyWriter() io.Writer {
+	switch len(r.writers) {
+	case 0:
+		return nil
+	case 1:
+		return r.writers[0]
+	default:
+		return io.MultiWriter(r.writers...)
+	}
+}
+
+// failures returns a bitmask of the checks the response failed, once its
+// body has been read. body is nil unless needsBody.
+func (r *checkRun) failures(response *http.Response, body []byte) uint64 {
+	var failed uint64
+	for i, check := range r.checks.checks {
+		bit := uint64(1) << uint(i)
+		if r.applying&bit == 0 {
+			continue
+		}
+		var passed bool
+		if s, ok := r.streamed[i]; ok {
+			passed = s()
+		} else {
+			passed = check.(bodyCheck).passes(response, body)
+		}
+		if !passed {
+			failed |= bit
+		}
+	}
+	return failed
+}
+
+// hashFailures returns how many of counts, indexed like checks, are hash
+// check failures.
+func (c *responseChecks) hashFailures(counts *[maxChecks]uint64) uint64 {
+	if !c.hashed {
+		return 0
+	}
+	return counts[0]
+}
+
+// assertions returns the assertions among checks with their failure
+// counts from counts.
+func (c *responseChecks) assertions(counts *[maxChecks]uint64) ([]responseCheck, []uint64) {
+	first := 0
+	if c.hashed {
+		first = 1
+	}
+	return c.checks[first:], counts[first:len(c.checks)]
+}
+
+// formatAssertionFailures formats the failure counts of assertions like
+// formatCounts, but in the order the assertions were given.
+func formatAssertionFailures(asserts []responseCheck, counts []uint64) string {
+	if len(asserts) == 0 {
+		return "-"
+	}
+	pairs := make([]string, len(asserts))
+	for i, a := range asserts {
+		pairs[i] = fmt.Sprintf("%s:%d", a.name(), counts[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// defaultChecks only classify responses by the default rules.
+var defaultChecks = &responseChecks{classify: newClassifier(nil, nil)}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJSONValues(t *testing.T) {
+	body := []byte(`{"status": "ok", "count": 3, "items": [{"id": 7, "live": true}]}`)
+	for _, c := range []struct {
+		spec    string
+		matches bool
+	}{
+		{"json:.status=ok", true},
+		{"json:status=ok", true},
+		{"json:.status=down", false},
+		{"json:.count=3", true},
+		{"json:.items.0.id=7", true},
+		{"json:.items.0.live=true", true},
+		{"json:.items.1.id=7", false},
+		{"json:.missing=ok", false},
+	} {
+		rule, err := parseResponseRule(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.matches(response(200, nil), body); got != c.matches {
+			t.Errorf("Expected %s to match=%t", c.spec, c.matches)
+		}
+	}
+	rule, _ := parseResponseRule("json:.status=ok")
+	if rule.matches(response(200, nil), []byte("not json")) {
+		t.Errorf("Expected a body that isn't JSON not to match")
+	}
+	if _, err := parseResponseRule("json:.status"); err == nil {
+		t.Errorf("Expected an error parsing a json condition without a value")
+	}
+}
+
+func TestAbsentHeaders(t *testing.T) {
+	rule, err := parseResponseRule("!header:x-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rule.matches(response(200, nil), nil) {
+		t.Errorf("Expected a response without X-Debug to match")
+	}
+	if rule.matches(response(200, map[string]string{"X-Debug": "1"}), nil) {
+		t.Errorf("Expected a response with X-Debug not to match")
+	}
+}
+
+func TestAssertionScope(t *testing.T) {
+	var asserts assertions
+	if err := asserts.Set("status:200"); err != nil {
+		t.Fatal(err)
+	}
+	if err := asserts.Set("url:/users/,header:X-User"); err != nil {
+		t.Fatal(err)
+	}
+	if asserts[0].name() != "a1" || asserts[1].name() != "a2" {
+		t.Errorf("Expected assertions to be named a1 and a2, instead got %s and %s", asserts[0].name(), asserts[1].name())
+	}
+	users, _ := url.Parse("http://localhost/users/1")
+	other, _ := url.Parse("http://localhost/health")
+	if !asserts[0].applies(other) || !asserts[1].applies(users) || asserts[1].applies(other) {
+		t.Errorf("Expected a1 to apply everywhere and a2 only to /users/")
+	}
+
+	for _, spec := range []string{"url:/users/", "url:[,status:200", "url:/users/,code:200"} {
+		if err := asserts.Set(spec); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestChecksCountFailuresSeparately(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	client := newClient(false, false, 1, time.Second, connLimits{}, false)
+	// Close the connection here rather than in the background once the
+	// server goes, where it would count toward other tests' connections.
+	defer client.CloseIdleConnections()
+
+	hasher := fnv.New64a()
+	hasher.Write([]byte(`{"status": "ok"}`))
+	var asserts assertions
+	asserts.Set("json:.status=ok")
+	asserts.Set("header:X-Missing")
+	asserts.Set("url:/elsewhere,status:500")
+	hashes, err := newHashCheck("fnv-1a", 1, strconv.FormatUint(hasher.Sum64(), 10), "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks, err := newResponseChecks(newClassifier(nil, nil), hashes, asserts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 1, time.Time{}, false, checks, make([]byte, 512))
+	if resp.err != nil || !resp.good {
+		t.Fatalf("Expected a good response, instead got %v", resp.err)
+	}
+	// Only the header assertion, a2, fails. The hash check comes first.
+	if resp.failedChecks != 1<<2 {
+		t.Errorf("Expected only a2 to fail, instead got failures %b", resp.failedChecks)
+	}
+
+	rec := newRecorder(1, newBenchmarkStats, time.Millisecond)
+	rec.record(0, &resp)
+	rec.record(0, &resp)
+	stats := newBenchmarkStats()
+	rec.collect(stats)
+	if n := checks.hashFailures(&stats.checkFailures); n != 0 {
+		t.Errorf("Expected no hash check failures, instead got %d", n)
+	}
+	_, failures := checks.assertions(&stats.checkFailures)
+	if len(failures) != 3 || failures[0] != 0 || failures[1] != 2 || failures[2] != 0 {
+		t.Errorf("Expected a2 to fail twice, instead got %v", failures)
+	}
+}
+
+func TestAssertionFailuresKeepTheirOrder(t *testing.T) {
+	var asserts assertions
+	for i := 0; i < 10; i++ {
+		if err := asserts.Set("status:200"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checks, _ := newResponseChecks(newClassifier(nil, nil), nil, asserts)
+	var counts [maxChecks]uint64
+	counts[1] = 3
+	counts[9] = 1
+	expected := "a1:0,a2:3,a3:0,a4:0,a5:0,a6:0,a7:0,a8:0,a9:0,a10:1"
+	if got := formatAssertionFailures(checks.assertions(&counts)); got != expected {
+		t.Errorf("Expected %s, instead got %s", expected, got)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connsOpened and connsClosed count the connections opened to and closed
+// from the target since they were last reset.
+var connsOpened = uint64(0)
+var connsClosed = uint64(0)
+
+// dialed holds the open connections slow_cooker dialed by their local and
+// remote addresses, so that they can be found underneath the TLS
+// connections the transport wraps them in.
+var dialed = struct {
+	sync.Mutex
+	conns map[string]*countedConn
+}{conns: make(map[string]*countedConn)}
+
+// connKey identifies an open connection by its local and remote addresses,
+// which a TLS connection reports as those of the connection underneath.
+func connKey(conn net.Conn) string {
+	return conn.LocalAddr().String() + "-" + conn.RemoteAddr().String()
+}
+
+// connLimits bound how long a connection is used for. Zero means no limit.
+type connLimits struct {
+	maxRequests int
+	maxAge      time.Duration
+}
+
+// countedConn counts itself as closed the first time it is closed, and
+// closes itself once it reaches its limits.
+type countedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	limits    connLimits
+	expiry    *time.Timer
+
+	sync.Mutex
+	requests int
+	busy     bool
+	expired  bool
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+		dialed.Lock()
+		if key := connKey(c); dialed.conns[key] == c {
+			delete(dialed.conns, key)
+		}
+		dialed.Unlock()
+		atomic.AddUint64(&connsClosed, 1)
+		promConnsClosed.Inc()
+	})
+	return c.Conn.Close()
+}
+
+// acquire marks the connection as in use by a request.
+func (c *countedConn) acquire() {
+	c.Lock()
+	defer c.Unlock()
+	c.busy = true
+	c.requests++
+}
+
+// release marks the connection as no longer in use by a request, closing
+// it if it has reached its limits. A request that picks the connection up
+// before it is closed fails to write to it, and the transport retries it
+// on another connection.
+func (c *countedConn) release() {
+	c.Lock()
+	c.busy = false
+	done := c.expired || (c.limits.maxRequests > 0 && c.requests >= c.limits.maxRequests)
+	c.Unlock()
+	if done {
+		c.Close()
+	}
+}
+
+// expire closes the connection once it reaches its maximum age, or as
+// soon as the request using it is done.
+func (c *countedConn) expire() {
+	c.Lock()
+	c.expired = true
+	idle := !c.busy
+	c.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+// countedConnOf returns the countedConn underneath conn, if any.
+func countedConnOf(conn net.Conn) *countedConn {
+	if _, ok := conn.(*tls.Conn); ok {
+		dialed.Lock()
+		defer dialed.Unlock()
+		return dialed.conns[connKey(conn)]
+	}
+	c, _ := conn.(*countedConn)
+	return c
+}
+
+// countingDialer wraps dial to count the connections it opens and that are
+// later closed, and to hold them to limits.
+func countingDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), limits connLimits) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(&connsOpened, 1)
+		promConnsOpened.Inc()
+		c := &countedConn{Conn: conn, limits: limits}
+		dialed.Lock()
+		dialed.conns[connKey(c)] = c
+		dialed.Unlock()
+		if limits.maxAge > 0 {
+			c.Lock()
+			c.expiry = time.AfterFunc(limits.maxAge, c.expire)
+			c.Unlock()
+		}
+		return c, nil
+	}
+}
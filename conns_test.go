@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionsAreTracked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	atomic.StoreUint64(&connsOpened, 0)
+	atomic.StoreUint64(&connsClosed, 0)
+
+	// The first request opens a connection the second one reuses.
+	client := newClient(false, false, 1, time.Second, connLimits{}, false)
+	for i := uint64(1); i <= 2; i++ {
+		resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, i, time.Time{}, false, nil, make([]byte, 512))
+		if resp.err != nil {
+			t.Fatal(resp.err)
+		}
+		if !resp.conn.got || resp.conn.reused != (i == 2) {
+			t.Errorf("Expected request %d to have reused=%t, instead got %+v", i, i == 2, resp.conn)
+		}
+	}
+	if opened := atomic.LoadUint64(&connsOpened); opened != 1 {
+		t.Errorf("Expected 1 connection opened, instead got %d", opened)
+	}
+
+	// Without reuse every request opens and closes its own connection.
+	client = newClient(false, true, 1, time.Second, connLimits{}, false)
+	for i := uint64(3); i <= 4; i++ {
+		resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, i, time.Time{}, true, nil, make([]byte, 512))
+		if resp.err != nil {
+			t.Fatal(resp.err)
+		}
+		if resp.conn.reused {
+			t.Errorf("Expected request %d not to reuse a connection", i)
+		}
+	}
+	if opened := atomic.LoadUint64(&connsOpened); opened != 3 {
+		t.Errorf("Expected 3 connections opened, instead got %d", opened)
+	}
+	// Connections are closed in the background once a response is read.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&connsClosed) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if closed := atomic.LoadUint64(&connsClosed); closed != 2 {
+		t.Errorf("Expected 2 connections closed, instead got %d", closed)
+	}
+}
+
+func TestTLSResumptionsAreTracked(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+
+	// Without reuse, the second connection resumes the first's session.
+	client := newClient(false, true, 1, time.Second, connLimits{}, true)
+	for i := uint64(1); i <= 2; i++ {
+		resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, i, time.Time{}, true, nil, make([]byte, 512))
+		if resp.err != nil {
+			t.Fatal(resp.err)
+		}
+		if resp.conn.resumed != (i == 2) {
+			t.Errorf("Expected request %d to have resumed=%t", i, i == 2)
+		}
+	}
+
+	// Sessions are only cached when asked for.
+	client = newClient(false, true, 1, time.Second, connLimits{}, false)
+	for i := uint64(3); i <= 4; i++ {
+		resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, i, time.Time{}, true, nil, make([]byte, 512))
+		if resp.err != nil {
+			t.Fatal(resp.err)
+		}
+		if resp.conn.resumed {
+			t.Errorf("Expected request %d not to resume a session without resumeTLS", i)
+		}
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	atomic.StoreUint64(&connsOpened, 0)
+
+	// With two requests per connection, six requests need three.
+	client := newClient(false, false, 1, time.Second, connLimits{maxRequests: 2}, false)
+	for i := uint64(1); i <= 6; i++ {
+		resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, i, time.Time{}, false, nil, make([]byte, 512))
+		if resp.err != nil {
+			t.Fatal(resp.err)
+		}
+		if resp.conn.reused != (i%2 == 0) {
+			t.Errorf("Expected request %d to have reused=%t", i, i%2 == 0)
+		}
+	}
+	if opened := atomic.LoadUint64(&connsOpened); opened != 3 {
+		t.Errorf("Expected 3 connections opened, instead got %d", opened)
+	}
+
+	// A connection older than its maximum age is not reused.
+	client = newClient(false, false, 1, time.Second, connLimits{maxAge: 20 * time.Millisecond}, false)
+	for i := uint64(7); i <= 8; i++ {
+		resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, i, time.Time{}, false, nil, make([]byte, 512))
+		if resp.err != nil {
+			t.Fatal(resp.err)
+		}
+		if resp.conn.reused {
+			t.Errorf("Expected request %d to have a new connection", i)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Limits hold for connections underneath TLS too.
+	tlsServer := httptest.NewTLSServer(server.Config.Handler)
+	defer tlsServer.Close()
+	tlsURL, _ := url.Parse(tlsServer.URL)
+	client = newClient(false, false, 1, time.Second, connLimits{maxRequests: 2}, false)
+	for i := uint64(9); i <= 12; i++ {
+		resp := sendRequest(client, "GET", tlsURL, "", headerSet{}, nil, i, time.Time{}, false, nil, make([]byte, 512))
+		if resp.err != nil {
+			t.Fatal(resp.err)
+		}
+		if resp.conn.reused != (i%2 == 0) {
+			t.Errorf("Expected TLS request %d to have reused=%t", i, i%2 == 0)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The classes failed requests are counted under.
+const (
+	errTimeout = "timeout"
+	errRefused = "refused"
+	errReset   = "reset"
+	errDNS     = "dns"
+	errTLS     = "tls"
+	errEOF     = "eof"
+	errOther   = "other"
+)
+
+// errorClass returns the class of a request that failed with err.
+func errorClass(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errRefused
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return errReset
+	}
+	// Alerts from the server have no exported type before Go 1.21, but
+	// their messages start with "tls: " like most other TLS errors.
+	var recordErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &certErr) || strings.Contains(err.Error(), "tls: ") {
+		return errTLS
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errEOF
+	}
+	return errOther
+}
+
+// formatCounts formats counts as key:count pairs separated by commas and
+// ordered by key, or - if there are none.
+func formatCounts(counts map[string]uint64) string {
+	if len(counts) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s:%d", key, counts[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// formatCodes formats counts of status codes like formatCounts.
+func formatCodes(codes map[int]uint64) string {
+	counts := make(map[string]uint64, len(codes))
+	for code, n := range codes {
+		counts[strconv.Itoa(code)] = n
+	}
+	return formatCounts(counts)
+}
+
+// addCounts adds the counts in other to counts.
+func addCounts(counts map[string]uint64, other map[string]uint64) {
+	for key, n := range other {
+		counts[key] += n
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	for expected, err := range map[string]error{
+		errTimeout: &url.Error{Op: "Get", URL: "http://localhost", Err: timeoutError{}},
+		errDNS:     &url.Error{Op: "Get", URL: "http://nowhere", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nowhere"}}},
+		errRefused: &url.Error{Op: "Get", URL: "http://localhost", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}},
+		errReset:   &url.Error{Op: "Get", URL: "http://localhost", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}},
+		errTLS:     &url.Error{Op: "Get", URL: "https://localhost", Err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}},
+		errEOF:     &url.Error{Op: "Get", URL: "http://localhost", Err: io.EOF},
+		errOther:   errors.New("something else"),
+	} {
+		if class := errorClass(err); class != expected {
+			t.Errorf("Expected %v to be classed as %s, instead got %s", err, expected, class)
+		}
+	}
+}
+
+func TestFailedRequestsAreClassified(t *testing.T) {
+	// Nothing listens on a closed server's address, so connecting is refused.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dstURL, _ := url.Parse(server.URL)
+	server.Close()
+	client := newClient(false, false, 1, time.Second, connLimits{}, false)
+
+	resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 1, time.Time{}, false, nil, make([]byte, 512))
+	if resp.errClass != errRefused {
+		t.Errorf("Expected the request to be refused, instead got %s: %v", resp.errClass, resp.err)
+	}
+}
+
+func TestFormatCounts(t *testing.T) {
+	if got := formatCounts(map[string]uint64{}); got != "-" {
+		t.Errorf("Expected - for no counts, instead got %s", got)
+	}
+	if got := formatCounts(map[string]uint64{"reset": 2, "dns": 1}); got != "dns:1,reset:2" {
+		t.Errorf("Expected dns:1,reset:2, instead got %s", got)
+	}
+	if got := formatCodes(map[int]uint64{503: 2, 200: 98}); got != "200:98,503:2" {
+		t.Errorf("Expected 200:98,503:2, instead got %s", got)
+	}
+}
+
+func TestTimeoutsAreMarked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	client := newClient(false, false, 1, 10*time.Millisecond, connLimits{}, false)
+
+	resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 1, time.Time{}, false, nil, make([]byte, 512))
+	if resp.err == nil || !resp.timeout {
+		t.Errorf("Expected the request to time out, instead got %v", resp.err)
+	}
+
+	// Other failures are not timeouts.
+	server.Close()
+	resp = sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 2, time.Time{}, false, nil, make([]byte, 512))
+	if resp.err == nil || resp.timeout {
+		t.Errorf("Expected the request to fail without timing out, instead got %v", resp.err)
+	}
+}
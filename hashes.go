@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hashAlgorithms are the hashes response bodies can be checked with.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"fnv-1a": func() hash.Hash { return fnv.New64a() },
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// parseDigest parses a digest made by newHash. fnv-1a and crc32 digests
+// are numbers, given in decimal or with a 0x prefix in hex as -hashValue
+// always took, and longer ones are given in hex.
+func parseDigest(newHash func() hash.Hash, s string) ([]byte, error) {
+	size := newHash().Size()
+	if size <= 8 {
+		n, err := strconv.ParseUint(s, 0, size*8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest %q", s)
+		}
+		digest := make([]byte, 8)
+		binary.BigEndian.PutUint64(digest, n)
+		return digest[8-size:], nil
+	}
+	digest, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil || len(digest) != size {
+		return nil, fmt.Errorf("invalid digest %q, should be %d hex digits", s, 2*size)
+	}
+	return digest, nil
+}
+
+// readHashManifest reads lines of a url and the digest its response body
+// should have, separated by whitespace. Blank lines and lines starting
+// with # are skipped.
+func readHashManifest(r io.Reader, newHash func() hash.Hash) (map[string][]byte, error) {
+	digests := make(map[string][]byte)
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid manifest entry on line %d: '%s', should be <url> <digest>", i, line)
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL on line %d: '%s': %s", i, fields[0], err.Error())
+		}
+		digest, err := parseDigest(newHash, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i, err.Error())
+		}
+		digests[u.String()] = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// hashCheck checks a sample of response bodies against the digest
+// expected of their url, hashing them as they are read. Urls without a
+// digest can have one learned from their first responses.
+type hashCheck struct {
+	newHash    func() hash.Hash
+	sampleRate float64
+	// digest is expected of urls that byURL has no digest for. If it is nil
+	// those urls aren't checked unless their digest is learned.
+	digest []byte
+	byURL  map[string][]byte
+	// learn is how many responses from a url without a digest are hashed
+	// to learn it, 0 to not learn digests.
+	learn int
+	// mismatchDir is where the bodies of mismatched responses are written,
+	// unless it is empty.
+	mismatchDir string
+
+	sync.Mutex
+	learning map[string]*hashVotes
+	// learned holds the digests learned by url, or nil for urls whose
+	// responses had no digest in common enough to learn.
+	learned map[string][]byte
+}
+
+// hashVotes counts the digests of the responses from a url whose digest
+// is being learned.
+type hashVotes struct {
+	count int
+	// digests are in the order they were first seen, with their counts in
+	// votes and, when mismatches are written out, a body in bodies.
+	digests []string
+	votes   map[string]int
+	bodies  map[string][]byte
+}
+
+// newHashCheck returns a check of bodies hashed with algorithm against
+// value, if set, and the digests in the manifest read from path, if set.
+// The digests of other urls are learned from their first learn responses,
+// and mismatched bodies are written to mismatchDir, which is created if
+// need be, unless it is empty.
+func newHashCheck(algorithm string, sampleRate float64, value string, path string, learn int, mismatchDir string) (*hashCheck, error) {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, should be [fnv-1a|crc32|sha256|md5]", algorithm)
+	}
+	c := &hashCheck{
+		newHash:     newHash,
+		sampleRate:  sampleRate,
+		learn:       learn,
+		mismatchDir: mismatchDir,
+		learning:    make(map[string]*hashVotes),
+		learned:     make(map[string][]byte),
+	}
+	if mismatchDir != "" {
+		if err := os.MkdirAll(mismatchDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if value != "" {
+		digest, err := parseDigest(newHash, value)
+		if err != nil {
+			return nil, err
+		}
+		c.digest = digest
+	}
+	if path != "" {
+		file, err := openSource(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		c.byURL, err = readHashManifest(file, newHash)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	return c, nil
+}
+
+// expected returns the digest expected of the body of a response from u,
+// or nil if there is none yet.
+func (c *hashCheck) expected(u *url.URL) []byte {
+	key := u.String()
+	if digest, ok := c.byURL[key]; ok {
+		return digest
+	}
+	if c.digest != nil || c.learn == 0 {
+		return c.digest
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.learned[key]
+}
+
+func (c *hashCheck) name() string {
+	return "bhash"
+}
+
+// applies to a sample of responses from urls with a digest, and to every
+// response from a url whose digest is being learned.
+func (c *hashCheck) applies(u *url.URL) bool {
+	if c.expected(u) == nil {
+		return c.learns(u)
+	}
+	return shouldCheckHash(c.sampleRate)
+}
+
+// learns returns true if the digest of u is still being learned.
+func (c *hashCheck) learns(u *url.URL) bool {
+	if c.learn == 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	_, done := c.learned[u.String()]
+	return !done
+}
+
+func (c *hashCheck) stream(u *url.URL, reqID uint64) (io.Writer, func() bool) {
+	expected := c.expected(u)
+	h := c.newHash()
+	w := io.Writer(h)
+	// The body is only kept when it may need writing out.
+	var body *bytes.Buffer
+	if c.mismatchDir != "" {
+		body = &bytes.Buffer{}
+		w = io.MultiWriter(h, body)
+	}
+	return w, func() bool {
+		var b []byte
+		if body != nil {
+			b = body.Bytes()
+		}
+		sum := h.Sum(nil)
+		if expected == nil {
+			c.vote(u, sum, b)
+			return true
+		}
+		if !bytes.Equal(sum, expected) {
+			c.mismatch(u, reqID, sum, expected, b)
+			return false
+		}
+		return true
+	}
+}
+
+// vote counts the digest of a response from u towards learning its
+// digest. Once learn responses are in, the digest more than half of them
+// had is expected of later responses. If none did, that is reported and
+// the url isn't checked.
+func (c *hashCheck) vote(u *url.URL, sum []byte, body []byte) {
+	key := u.String()
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.learned[key]; ok {
+		// Responses that were in flight while it was learned don't count.
+		return
+	}
+	v, ok := c.learning[key]
+	if !ok {
+		v = &hashVotes{votes: make(map[string]int), bodies: make(map[string][]byte)}
+		c.learning[key] = v
+	}
+	digest := string(sum)
+	if _, ok := v.votes[digest]; !ok {
+		v.digests = append(v.digests, digest)
+		if body != nil {
+			v.bodies[digest] = body
+		}
+	}
+	v.votes[digest]++
+	v.count++
+	if v.count < c.learn {
+		return
+	}
+
+	best := v.digests[0]
+	for _, digest := range v.digests[1:] {
+		if v.votes[digest] > v.votes[best] {
+			best = digest
+		}
+	}
+	delete(c.learning, key)
+	if 2*v.votes[best] <= v.count {
+		c.learned[key] = nil
+		fmt.Fprintf(os.Stderr, "no hash of %s had a majority of %d responses, not checking it\n", key, v.count)
+		return
+	}
+	c.learned[key] = []byte(best)
+	fmt.Fprintf(os.Stderr, "learned hash %x of %s from %d of %d responses\n", best, key, v.votes[best], v.count)
+	if c.mismatchDir != "" {
+		c.writeBody(key, "expected", v.bodies[best])
+	}
+}
+
+// mismatch reports a response to request reqID from u whose body hashed to
+// sum rather than expected.
+func (c *hashCheck) mismatch(u *url.URL, reqID uint64, sum []byte, expected []byte, body []byte) {
+	key := u.String()
+	fmt.Fprintf(os.Stderr, "hash mismatch on %s for Sc-Req-Id %d: got %x, expected %x\n", key, reqID, sum, expected)
+	if c.mismatchDir != "" {
+		c.writeBody(key, strconv.FormatUint(reqID, 10), body)
+	}
+}
+
+// writeBody writes a body of a response from the url key to mismatchDir,
+// named after the url and suffix.
+func (c *hashCheck) writeBody(key string, suffix string, body []byte) {
+	name := filepath.Join(c.mismatchDir, url.PathEscape(key)+"."+suffix)
+	if err := ioutil.WriteFile(name, body, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDigest(t *testing.T) {
+	body := []byte("hello")
+	fnvHash := fnv.New64a()
+	fnvHash.Write(body)
+	sha := sha256.Sum256(body)
+	md := md5.Sum(body)
+
+	for _, c := range []struct{ algorithm, value string }{
+		{"fnv-1a", strconv.FormatUint(fnvHash.Sum64(), 10)},
+		{"fnv-1a", "0x" + hex.EncodeToString(fnvHash.Sum(nil))},
+		{"crc32", strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 10)},
+		{"sha256", hex.EncodeToString(sha[:])},
+		{"md5", hex.EncodeToString(md[:])},
+	} {
+		newHash := hashAlgorithms[c.algorithm]
+		digest, err := parseDigest(newHash, c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newHash()
+		h.Write(body)
+		if string(digest) != string(h.Sum(nil)) {
+			t.Errorf("Expected %s digest %s to be %x, instead got %x", c.algorithm, c.value, h.Sum(nil), digest)
+		}
+	}
+
+	// Short hex digests are numbers, as -hashValue always took them.
+	if digest, err := parseDigest(hashAlgorithms["crc32"], "0x1f"); err != nil || string(digest) != "\x00\x00\x00\x1f" {
+		t.Errorf("Expected crc32 digest 0x1f to be 0000001f, instead got %x, %v", digest, err)
+	}
+
+	for _, c := range []struct{ algorithm, value string }{
+		{"fnv-1a", "abc"},
+		{"crc32", "99999999999"},
+		{"sha256", "abcd"},
+		{"md5", "not hex"},
+	} {
+		if _, err := parseDigest(hashAlgorithms[c.algorithm], c.value); err == nil {
+			t.Errorf("Expected an error parsing %s digest %q", c.algorithm, c.value)
+		}
+	}
+	if _, err := newHashCheck("sha1", 1, "", "", 0, ""); err == nil {
+		t.Errorf("Expected an error for an unknown hash algorithm")
+	}
+}
+
+func TestHashManifest(t *testing.T) {
+	manifest := `# expected digests
+http://localhost/a 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824
+
+http://localhost/b 0000000000000000000000000000000000000000000000000000000000000000
+`
+	digests, err := readHashManifest(strings.NewReader(manifest), hashAlgorithms["sha256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 2 {
+		t.Errorf("Expected 2 digests, instead got %d", len(digests))
+	}
+
+	c := &hashCheck{newHash: hashAlgorithms["sha256"], sampleRate: 1, byURL: digests}
+	for path, passes := range map[string]bool{"/a": true, "/b": false} {
+		u, _ := url.Parse("http://localhost" + path)
+		if !c.applies(u) {
+			t.Fatalf("Expected the check to apply to %s", u)
+		}
+		w, passed := c.stream(u, 1)
+		w.Write([]byte("hel"))
+		w.Write([]byte("lo"))
+		if passed() != passes {
+			t.Errorf("Expected %s to pass=%t", u, passes)
+		}
+	}
+	// Urls missing from the manifest are only checked against -hashValue.
+	other, _ := url.Parse("http://localhost/c")
+	if c.applies(other) {
+		t.Errorf("Expected the check not to apply to a url missing from the manifest")
+	}
+
+	for _, bad := range []string{"http://localhost/a", "http://localhost/a abc", "%zz 00"} {
+		if _, err := readHashManifest(strings.NewReader(bad), hashAlgorithms["sha256"]); err == nil {
+			t.Errorf("Expected an error reading manifest %q", bad)
+		}
+	}
+}
+
+func TestHashIsStreamed(t *testing.T) {
+	body := strings.Repeat("slow_cooker ", 10000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	client := newClient(false, false, 1, time.Second, connLimits{}, false)
+	defer client.CloseIdleConnections()
+
+	sum := sha256.Sum256([]byte(body))
+	hashes, err := newHashCheck("sha256", 1, hex.EncodeToString(sum[:]), "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks, _ := newResponseChecks(newClassifier(nil, nil), hashes, nil)
+	if checks.start(dstURL, 1).needsBody() {
+		t.Errorf("Expected the hash check not to need the whole body")
+	}
+	resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 1, time.Time{}, false, checks, make([]byte, 512))
+	if resp.err != nil {
+		t.Fatal(resp.err)
+	}
+	if resp.failedChecks != 0 || resp.sz != uint64(len(body)) {
+		t.Errorf("Expected the hash check to pass on a %d byte body, instead got failures %b on %d bytes", len(body), resp.failedChecks, resp.sz)
+	}
+}
+
+func TestHashIsLearned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slow_cooker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newHashCheck("sha256", 1, "", "", 3, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://localhost/users/1")
+
+	// The body most of the first three had is expected of the rest.
+	for i, body := range []string{"stale", "fresh", "fresh"} {
+		if !c.applies(u) {
+			t.Fatalf("Expected every response to be hashed while learning")
+		}
+		w, passed := c.stream(u, uint64(i+1))
+		w.Write([]byte(body))
+		if !passed() {
+			t.Errorf("Expected responses not to fail while learning")
+		}
+	}
+	fresh := sha256.Sum256([]byte("fresh"))
+	if string(c.expected(u)) != string(fresh[:]) {
+		t.Errorf("Expected the hash of fresh to be learned, instead got %x", c.expected(u))
+	}
+
+	for reqID, body := range map[uint64]string{4: "fresh", 5: "stale"} {
+		w, passed := c.stream(u, reqID)
+		w.Write([]byte(body))
+		if passed() != (body == "fresh") {
+			t.Errorf("Expected a %s body to pass=%t", body, body == "fresh")
+		}
+	}
+
+	// The expected body and the mismatched one are written out for diffing.
+	prefix := filepath.Join(dir, url.PathEscape(u.String()))
+	for suffix, body := range map[string]string{"expected": "fresh", "5": "stale"} {
+		b, err := ioutil.ReadFile(prefix + "." + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Errorf("Expected %s to hold %s, instead got %s", prefix+"."+suffix, body, b)
+		}
+	}
+	if _, err := os.Stat(prefix + ".4"); !os.IsNotExist(err) {
+		t.Errorf("Expected a matching body not to be written out")
+	}
+}
+
+func TestHashNeedsMajorityToBeLearned(t *testing.T) {
+	c, err := newHashCheck("sha256", 1, "", "", 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://localhost/users/1")
+
+	// Two of four isn't a majority, so the url isn't checked after all.
+	for i, body := range []string{"a", "b", "a", "c"} {
+		w, passed := c.stream(u, uint64(i+1))
+		w.Write([]byte(body))
+		passed()
+	}
+	if c.expected(u) != nil {
+		t.Errorf("Expected no hash to be learned without a majority, instead got %x", c.expected(u))
+	}
+	if c.applies(u) {
+		t.Errorf("Expected a url without a learned hash not to be checked")
+	}
+}
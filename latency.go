@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// latencyMeasures are the ways the latency of a response can be measured.
+// Most are taken from when the request was sent, or in open mode from when
+// it was meant to be sent, and so include setting up a connection when
+// one was needed. The -conn measures leave that out.
+var latencyMeasures = map[string]func(*MeasuredResponse) time.Duration{
+	// ttfb is the time to the first byte of the response.
+	"ttfb": func(r *MeasuredResponse) time.Duration { return r.latency },
+	// ttlb is the time to the last byte of the response.
+	"ttlb": func(r *MeasuredResponse) time.Duration { return r.lastByte },
+	// ttfb-conn is the time to the first byte from when the request got a
+	// connection.
+	"ttfb-conn": func(r *MeasuredResponse) time.Duration { return r.latency - r.setup },
+	// ttlb-conn is the time to the last byte from when the request got a
+	// connection.
+	"ttlb-conn": func(r *MeasuredResponse) time.Duration { return r.lastByte - r.setup },
+	// total is ttlb plus the time spent queued for a slot in pool mode. In
+	// the other modes nothing is queued, so it is the same as ttlb.
+	"total": func(r *MeasuredResponse) time.Duration { return r.lastByte + r.queueWait },
+}
+
+// parseLatencyMeasures parses a comma separated list of one or two
+// latency measures. The first drives the main histogram and the second,
+// if given, is reported alongside it.
+func parseLatencyMeasures(spec string) ([]string, error) {
+	names := strings.Split(spec, ",")
+	if len(names) > 2 {
+		return nil, fmt.Errorf("at most two latency measures can be given, got %d", len(names))
+	}
+	for _, name := range names {
+		if _, ok := latencyMeasures[name]; !ok {
+			return nil, fmt.Errorf("unknown latency measure %q, should be [ttfb|ttlb|ttfb-conn|ttlb-conn|total]", name)
+		}
+	}
+	if len(names) == 2 && names[0] == names[1] {
+		return nil, fmt.Errorf("latency measures must differ, got %s twice", names[0])
+	}
+	return names, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLatencyMeasures(t *testing.T) {
+	for spec, expected := range map[string][]string{
+		"ttfb":           {"ttfb"},
+		"ttlb,ttfb":      {"ttlb", "ttfb"},
+		"total":          {"total"},
+		"ttlb,ttlb-conn": {"ttlb", "ttlb-conn"},
+	} {
+		names, err := parseLatencyMeasures(spec)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", spec, err)
+			continue
+		}
+		if len(names) != len(expected) || names[0] != expected[0] {
+			t.Errorf("Expected %q to parse to %v, instead got %v", spec, expected, names)
+		}
+	}
+	for _, spec := range []string{"", "ttfb,ttfb", "ttfb,ttlb,total", "rtt"} {
+		if _, err := parseLatencyMeasures(spec); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestLatencyMeasures(t *testing.T) {
+	resp := &MeasuredResponse{latency: 10 * time.Millisecond, lastByte: 15 * time.Millisecond, setup: 3 * time.Millisecond, queueWait: 5 * time.Millisecond}
+	for name, expected := range map[string]time.Duration{
+		"ttfb":      10 * time.Millisecond,
+		"ttlb":      15 * time.Millisecond,
+		"ttfb-conn": 7 * time.Millisecond,
+		"ttlb-conn": 12 * time.Millisecond,
+		"total":     20 * time.Millisecond,
+	} {
+		if got := latencyMeasures[name](resp); got != expected {
+			t.Errorf("Expected %s of %s, instead got %s", name, expected, got)
+		}
+	}
+}
@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
@@ -20,6 +17,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,7 +25,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/buoyantio/slow_cooker/arrival"
 	"github.com/buoyantio/slow_cooker/hdrreport"
+	"github.com/buoyantio/slow_cooker/profile"
 	"github.com/buoyantio/slow_cooker/ring"
 	"github.com/buoyantio/slow_cooker/window"
 	"github.com/codahale/hdrhistogram"
@@ -38,12 +38,28 @@ import (
 // MeasuredResponse holds metadata about the response
 // we receive from the server under test.
 type MeasuredResponse struct {
-	sz              uint64
-	code            int
-	latency         time.Duration
-	timeout         bool
-	failedHashCheck bool
-	err             error
+	sz       uint64
+	code     int
+	good     bool
+	latency  time.Duration
+	lastByte time.Duration
+	// setup is how long the request took to get a connection, including
+	// resolving, dialing and handshaking a new one.
+	setup      time.Duration
+	altLatency time.Duration
+	timeout    bool
+	errClass   string
+	// failedChecks is a bitmask of the response checks that failed.
+	failedChecks uint64
+	queueWait    time.Duration
+	burst        bool
+	stages       stageTimes
+	conn         connUse
+	group        *urlGroup
+	// phase is the phase of the run the request was sent in, or "" for
+	// steady state.
+	phase string
+	err   error
 }
 
 func newClient(
@@ -51,17 +67,27 @@ func newClient(
 	noreuse bool,
 	maxConn int,
 	timeout time.Duration,
+	limits connLimits,
+	resumeTLS bool,
 ) *http.Client {
 	tr := http.Transport{
 		DisableCompression:  !compress,
 		DisableKeepAlives:   noreuse,
 		MaxIdleConnsPerHost: maxConn,
 		Proxy:               http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
+		// Dialing with a context lets httptrace time connecting.
+		DialContext: countingDialer((&net.Dialer{
 			Timeout: 5 * time.Second,
-		}).Dial,
+		}).DialContext, limits),
 		TLSHandshakeTimeout: 5 * time.Second,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	// Caching sessions lets new connections skip the full handshake, which
+	// changes what is measured, so it is left to the caller.
+	if resumeTLS {
+		tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
 	}
 	return &http.Client{
 		Timeout:   timeout,
@@ -77,14 +103,16 @@ func sendRequest(
 	headers headerSet,
 	requestData []byte,
 	reqID uint64,
+	intended time.Time,
 	noreuse bool,
-	hashValue uint64,
-	checkHash bool,
-	hasher hash.Hash64,
-	received chan *MeasuredResponse,
+	checks *responseChecks,
 	bodyBuffer []byte,
-) {
-	req, err := http.NewRequest(method, url.String(), bytes.NewBuffer(requestData))
+) MeasuredResponse {
+	var body io.Reader
+	if len(requestData) > 0 {
+		body = bytes.NewReader(requestData)
+	}
+	req, err := http.NewRequest(method, url.String(), body)
 	req.Close = noreuse
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -98,50 +126,76 @@ func sendRequest(
 		req.Header.Add(k, v)
 	}
 
-	var elapsed time.Duration
+	// In open mode latency is measured from when the request was
+	// scheduled to go out rather than when it actually did, so that
+	// time spent queued behind a slow server is not hidden.
+	// Pacers may release a send slightly ahead of its intended time, so
+	// never measure from a time that hasn't come yet.
 	start := time.Now()
-
-	trace := &httptrace.ClientTrace{
-		GotFirstResponseByte: func() {
-			elapsed = time.Since(start)
-		},
+	if !intended.IsZero() && intended.Before(start) {
+		start = intended
 	}
 
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	tracer := &stageTracer{}
+	defer tracer.releaseConn()
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), tracer.clientTrace()))
 	response, err := client.Do(req)
 
 	if err != nil {
-		received <- &MeasuredResponse{err: err}
-	} else {
-		defer response.Body.Close()
-		if !checkHash {
-			if sz, err := io.CopyBuffer(ioutil.Discard, response.Body, bodyBuffer); err == nil {
-
-				received <- &MeasuredResponse{
-					sz:      uint64(sz),
-					code:    response.StatusCode,
-					latency: elapsed}
-			} else {
-				received <- &MeasuredResponse{err: err}
-			}
-		} else {
-			if bytes, err := ioutil.ReadAll(response.Body); err != nil {
-				received <- &MeasuredResponse{err: err}
-			} else {
-				hasher.Write(bytes)
-				sum := hasher.Sum64()
-				failedHashCheck := false
-				if hashValue != sum {
-					failedHashCheck = true
-				}
-				received <- &MeasuredResponse{
-					sz:              uint64(len(bytes)),
-					code:            response.StatusCode,
-					latency:         elapsed,
-					failedHashCheck: failedHashCheck}
-			}
+		return failedResponse(err)
+	}
+	defer response.Body.Close()
+	elapsed := tracer.firstByteAt().Sub(start)
+	setup := tracer.gotConnAt().Sub(start)
+	if checks == nil {
+		checks = defaultChecks
+	}
+	// Streaming checks see the body as it is read, so it is only read
+	// into memory if a check needs all of it.
+	run := checks.start(url, reqID)
+	reader := io.Reader(response.Body)
+	if w := run.bodyWriter(); w != nil {
+		reader = io.TeeReader(response.Body, w)
+	}
+	if !run.needsBody() {
+		sz, err := io.CopyBuffer(ioutil.Discard, reader, bodyBuffer)
+		if err != nil {
+			return failedResponse(err)
 		}
+		end := time.Now()
+		return MeasuredResponse{
+			sz:           uint64(sz),
+			code:         response.StatusCode,
+			good:         checks.classify.isGood(response, nil),
+			latency:      elapsed,
+			lastByte:     end.Sub(start),
+			setup:        setup,
+			failedChecks: run.failures(response, nil),
+			stages:       tracer.finish(end),
+			conn:         tracer.connection()}
+	}
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return failedResponse(err)
 	}
+	end := time.Now()
+	return MeasuredResponse{
+		sz:           uint64(len(bytes)),
+		code:         response.StatusCode,
+		good:         checks.classify.isGood(response, bytes),
+		latency:      elapsed,
+		lastByte:     end.Sub(start),
+		setup:        setup,
+		failedChecks: run.failures(response, bytes),
+		stages:       tracer.finish(end),
+		conn:         tracer.connection()}
+}
+
+// failedResponse describes a request that failed with err, noting how it
+// failed.
+func failedResponse(err error) MeasuredResponse {
+	class := errorClass(err)
+	return MeasuredResponse{err: err, errClass: class, timeout: class == errTimeout}
 }
 
 func exUsage(msg string, args ...interface{}) {
@@ -155,16 +209,32 @@ func CalcTimeToWait(qps *int) time.Duration {
 	return time.Duration(int(time.Second) / *qps)
 }
 
+// CalcTimeToWaitForRate calculates how many Nanoseconds to wait between
+// actions at a possibly fractional rate of actions per second.
+func CalcTimeToWaitForRate(rate float64) time.Duration {
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// formatRate formats a request rate to at most three decimal places
+// without trailing zeros.
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(math.Round(rate*1000)/1000, 'f', -1, 64)
+}
+
 var reqID = uint64(0)
 
-var shouldFinish = false
-var shouldFinishLock sync.RWMutex
+// inFlightCount is the number of requests waiting for a response.
+var inFlightCount = int64(0)
+
+// finished is closed once the system should stop sending traffic.
+var finished = make(chan struct{})
+var finishOnce sync.Once
 
 // finishSendingTraffic signals the system to stop sending traffic and clean up after itself.
 func finishSendingTraffic() {
-	shouldFinishLock.Lock()
-	shouldFinish = true
-	shouldFinishLock.Unlock()
+	finishOnce.Do(func() {
+		close(finished)
+	})
 }
 
 type headerSet map[string]string
@@ -185,113 +255,170 @@ func (h *headerSet) Set(s string) error {
 }
 
 func loadData(data string) []byte {
-	var file *os.File
-	var requestData []byte
-	var err error
-	if strings.HasPrefix(data, "@") {
-		path := data[1:]
-		if path == "-" {
-			file = os.Stdin
-		} else {
-			file, err = os.Open(path)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, err.Error())
-				os.Exit(1)
-			}
-			defer file.Close()
-		}
-
-		requestData, err = ioutil.ReadAll(file)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
-			os.Exit(1)
-		}
-	} else {
-		requestData = []byte(data)
+	requestData, err := readData(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		os.Exit(1)
 	}
-
 	return requestData
 }
 
 func loadURLs(urldest string) []*url.URL {
-	var urls []*url.URL
-	var err error
-	var scanner *bufio.Scanner
-
-	if strings.HasPrefix(urldest, "@") {
-		var file *os.File
-		path := urldest[1:]
-		if path == "-" {
-			file = os.Stdin
-		} else {
-			file, err = os.Open(path)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, err.Error())
-				os.Exit(1)
-			}
-			defer file.Close()
-		}
-		scanner = bufio.NewScanner(file)
-	} else {
-		scanner = bufio.NewScanner(strings.NewReader(urldest))
-	}
-
-	for i := 1; scanner.Scan(); i++ {
-		line := scanner.Text()
-		URL, err := url.Parse(line)
-		if err != nil {
-			exUsage("invalid URL on line %d: '%s': %s\n", i, line, err.Error())
-		} else if URL.Scheme == "" {
-			exUsage("invalid URL on line %d: '%s': Missing scheme\n", i, line)
-		} else if URL.Host == "" {
-			exUsage("invalid URL on line %d: '%s': Missing host\n", i, line)
-		}
-		urls = append(urls, URL)
+	urls, err := readURLs(urldest)
+	if err != nil {
+		exUsage(err.Error())
 	}
-
 	return urls
 }
 
 var (
-	promRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	promRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "requests",
 		Help: "Number of requests",
-	})
+	}, []string{"url"})
 
-	promSuccesses = prometheus.NewCounter(prometheus.CounterOpts{
+	promSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "successes",
 		Help: "Number of successful requests",
+	}, []string{"url"})
+
+	promInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "inflight",
+		Help: "Number of requests waiting for a response",
+	})
+
+	promSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "requests_sent",
+		Help: "Number of requests sent by the request threads",
+	})
+
+	promSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "requests_skipped",
+		Help: "Number of sends skipped for falling behind schedule",
+	})
+
+	promTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "timeouts",
+		Help: "Number of requests that timed out",
+	})
+
+	promResponseBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "response_bytes",
+		Help: "Number of bytes of response bodies received",
+	})
+
+	promConnsOpened = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connections_opened",
+		Help: "Number of connections opened",
+	})
+
+	promConnsClosed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connections_closed",
+		Help: "Number of connections closed",
+	})
+
+	promConnsReused = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connections_reused",
+		Help: "Number of requests sent on a reused connection",
 	})
 
-	promLatencyMSHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	promTLSResumptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tls_resumptions",
+		Help: "Number of TLS handshakes that resumed an earlier session",
+	})
+
+	promConnIdleHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "connection_idle_us",
+		Help: "Time reused connections sat idle before a request in microseconds.",
+		// 50 exponential buckets ranging from 1 us to 2.4 seconds
+		Buckets: prometheus.ExponentialBuckets(1, 1.35, 50),
+	})
+
+	promStatusCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "status_codes",
+		Help: "Number of responses by status code",
+	}, []string{"code"})
+
+	promErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "errors",
+		Help: "Number of failed requests by class of error",
+	}, []string{"class"})
+
+	promCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "check_failures",
+		Help: "Number of responses that failed the hash check (bhash) or an assertion (a1, a2, ...)",
+	}, []string{"check"})
+
+	promLimitHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inflight_limit_hits",
+		Help: "Number of requests that queued because max-inflight was reached",
+	})
+
+	promLatencyMSHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "latency_ms",
 		Help: "RPC latency distributions in milliseconds.",
 		// 50 exponential buckets ranging from 0.5 ms to 3 minutes
 		// TODO: make this tunable
 		Buckets: prometheus.ExponentialBuckets(0.5, 1.3, 50),
-	})
-	promLatencyUSHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	}, []string{"url"})
+	promLatencyUSHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "latency_us",
 		Help: "RPC latency distributions in microseconds.",
 		// 50 exponential buckets ranging from 1 us to 2.4 seconds
 		// TODO: make this tunable
 		Buckets: prometheus.ExponentialBuckets(1, 1.35, 50),
-	})
-	promLatencyNSHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	}, []string{"url"})
+	promLatencyNSHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "latency_ns",
 		Help: "RPC latency distributions in nanoseconds.",
 		// 50 exponential buckets ranging from 1 ns to 0.4 seconds
 		// TODO: make this tunable
 		Buckets: prometheus.ExponentialBuckets(1, 1.5, 50),
-	})
+	}, []string{"url"})
 )
 
-func registerMetrics() {
+// promStageHistograms hold the latency of each stage of a request.
+var promStageHistograms = func() (h [numStages]prometheus.Histogram) {
+	for stage, name := range stageNames {
+		h[stage] = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: name + "_latency_us",
+			Help: "Latency distribution of the " + name + " stage of requests in microseconds.",
+			// 50 exponential buckets ranging from 1 us to 2.4 seconds
+			Buckets: prometheus.ExponentialBuckets(1, 1.35, 50),
+		})
+	}
+	return h
+}()
+
+// registerMetrics registers all metrics. targetRate reports the request
+// rate the load profile currently asks for.
+func registerMetrics(targetRate func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "target_rate",
+		Help: "Target requests per second of the load profile",
+	}, targetRate))
 	prometheus.MustRegister(promRequests)
 	prometheus.MustRegister(promSuccesses)
+	prometheus.MustRegister(promInFlight)
+	prometheus.MustRegister(promSent)
+	prometheus.MustRegister(promSkipped)
+	prometheus.MustRegister(promTimeouts)
+	prometheus.MustRegister(promResponseBytes)
+	prometheus.MustRegister(promStatusCodes)
+	prometheus.MustRegister(promErrors)
+	prometheus.MustRegister(promCheckFailures)
+	prometheus.MustRegister(promConnsOpened)
+	prometheus.MustRegister(promConnsClosed)
+	prometheus.MustRegister(promConnsReused)
+	prometheus.MustRegister(promTLSResumptions)
+	prometheus.MustRegister(promConnIdleHistogram)
+	prometheus.MustRegister(promLimitHits)
 	prometheus.MustRegister(promLatencyMSHistogram)
 	prometheus.MustRegister(promLatencyUSHistogram)
 	prometheus.MustRegister(promLatencyNSHistogram)
+	for _, h := range promStageHistograms {
+		prometheus.MustRegister(h)
+	}
 }
 
 // Sample Rate is between [0.0, 1.0] and determines what percentage of request bodies
@@ -302,26 +429,60 @@ func shouldCheckHash(sampleRate float64) bool {
 
 func main() {
 	qps := flag.Int("qps", 1, "QPS to send to backends per request thread")
+	rate := flag.Float64("rate", 0, "total requests per second to send across all request threads, overrides -qps")
 	concurrency := flag.Int("concurrency", 1, "Number of request threads")
 	numIterations := flag.Uint64("iterations", 0, "Number of iterations (0 for infinite)")
+	warmup := flag.Duration("warmup", 0, "time at the start of the run excluded from the latency summary")
+	cooldown := flag.Duration("cooldown", 0, "time at the end of the run excluded from the latency summary")
 	host := flag.String("host", "", "value of Host header to set")
 	method := flag.String("method", "GET", "HTTP method to use")
 	interval := flag.Duration("interval", 10*time.Second, "reporting interval")
 	noreuse := flag.Bool("noreuse", false, "don't reuse connections")
+	resumeTLS := flag.Bool("resumeTLS", false, "cache TLS sessions so that new connections can resume them")
 	compress := flag.Bool("compress", false, "use compression")
 	clientTimeout := flag.Duration("timeout", 10*time.Second, "individual request timeout")
 	noLatencySummary := flag.Bool("noLatencySummary", false, "suppress the final latency summary")
+	stageSummary := flag.Bool("stageSummary", false, "print a latency summary for each stage of a request after the final latency summary")
 	reportLatenciesCSV := flag.String("reportLatenciesCSV", "",
 		"filename to output hdrhistogram latencies in CSV")
 	latencyUnit := flag.String("latencyUnit", "ms", "latency units [ms|us|ns]")
+	latencySpec := flag.String("latency", "ttfb", "Latency to measure [ttfb|ttlb|ttfb-conn|ttlb-conn|total], optionally followed by a comma and a second one to report alongside it")
 	help := flag.Bool("help", false, "show help message")
 	totalRequests := flag.Uint64("totalRequests", 0, "total number of requests to send before exiting")
-	headers := make(headerSet)
-	flag.Var(&headers, "header", "HTTP request header. (can be repeated.)")
+	duration := flag.Duration("duration", 0, "how long to send traffic for (0 for no limit)")
+	burstSize := flag.Int("burstSize", 0, "number of extra requests in each burst (0 for no bursts)")
+	burstInterval := flag.Duration("burstInterval", 30*time.Second, "time between bursts")
+	burstRate := flag.Float64("burstRate", 0, "requests per second within a burst (0 for all at once)")
+	drainTimeout := flag.Duration("drainTimeout", 10*time.Second, "how long to wait for outstanding requests once traffic stops")
+	var headerValues headerFlags
+	flag.Var(&headerValues, "header", "HTTP request header, or @file of headers. (can be repeated.)")
 	data := flag.String("data", "", "HTTP request data")
 	metricAddr := flag.String("metric-addr", "", "address to serve metrics on")
-	hashValue := flag.Uint64("hashValue", 0, "fnv-1a hash value to check the request body against")
+	hashValue := flag.String("hashValue", "", "hash value to check the response body against, in decimal for fnv-1a and crc32 and in hex otherwise")
+	hashAlgorithm := flag.String("hashAlgorithm", "fnv-1a", "hash algorithm of hashValue and hashManifest [fnv-1a|crc32|sha256|md5]")
+	hashManifest := flag.String("hashManifest", "", "file of lines of a url and the hash value its response body should have")
+	learnHash := flag.Int("learnHash", 0, "number of responses from each url without a hash value whose majority hash is expected of later responses (0 to not learn)")
+	mismatchDir := flag.String("mismatchDir", "", "directory to write the bodies of responses that fail the hash check to, with the bodies learned hashes came from")
 	hashSampleRate := flag.Float64("hashSampleRate", 0.0, "Sampe Rate for checking request body's hash. Interval in the range of [0.0, 1.0]")
+	mode := flag.String("mode", "closed", "load model [closed|open|pool|churn]")
+	maxInFlight := flag.Int("max-inflight", 0, "maximum number of requests in flight in pool mode")
+	maxConnRequests := flag.Int("maxConnRequests", 0, "maximum number of requests to send on a connection before closing it (0 for no limit)")
+	maxConnAge := flag.Duration("maxConnAge", 0, "maximum time to keep a connection open for (0 for no limit)")
+	var goodRules, badRules responseRules
+	var asserts assertions
+	flag.Var(&goodRules, "good", "rule a response must match to be good, such as status:200-299,header:X-Failover (can be repeated)")
+	flag.Var(&badRules, "bad", "rule a response must not match to be good, such as body:error (can be repeated)")
+	flag.Var(&asserts, "assert", "rule every response must match, such as json:.status=ok, counted separately when it doesn't; start it with url:<regexp>, to only check matching urls (can be repeated)")
+	perURL := flag.String("perURL", "", "break down results by url [url|path|<regexp>], where matches of the regexp in the path are replaced by * to group urls")
+	churnRequests := flag.Int("churnRequests", 1, "number of requests to send on each new connection in churn mode")
+	searchStrategy := flag.String("search", "", "search for the highest sustainable rate [exponential|binary]")
+	searchMaxRate := flag.Float64("searchMaxRate", 0, "highest rate to try when searching (0 for no limit)")
+	searchPrecision := flag.Float64("searchPrecision", 0.05, "fraction of the capacity within which a binary search stops")
+	maxP99 := flag.Duration("maxP99", 0, "highest p99 latency of a passing search step")
+	maxErrorRate := flag.Float64("maxErrorRate", 0.01, "highest fraction of bad and failed requests of a passing search step")
+	minAchieved := flag.Float64("minAchieved", 0.95, "lowest fraction of the requests called for by its rate that a passing search step must send")
+	arrivalSpec := flag.String("arrival", "uniform", "how requests are spread out in time [uniform|poisson|jitter:<fraction>|@<samples file>]")
+	profileSpec := flag.String("profile", "", "load profile to follow instead of a fixed rate, e.g. ramp:<from>:<to>:<duration>, step:<rate>,<rate>,...:<hold> or @<schedule file>")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s <url> [flags]\n", path.Base(os.Args[0]))
@@ -342,7 +503,37 @@ func main() {
 	urldest := flag.Arg(0)
 	dstURLs := loadURLs(urldest)
 
-	if *qps < 1 {
+	if *rate < 0 {
+		exUsage("rate must be positive")
+	}
+
+	if *burstSize < 0 || *burstInterval <= 0 || *burstRate < 0 {
+		exUsage("burstSize, burstInterval and burstRate must be positive")
+	}
+
+	if *rate > 0 && *profileSpec != "" {
+		exUsage("rate and profile cannot both be set")
+	}
+
+	if *searchStrategy != "" {
+		if *searchStrategy != "exponential" && *searchStrategy != "binary" {
+			exUsage("search should be [exponential | binary].")
+		}
+		if *profileSpec != "" {
+			exUsage("search and profile cannot both be set")
+		}
+		if *maxP99 <= 0 {
+			exUsage("search requires maxP99 to be set")
+		}
+		if *searchPrecision <= 0 || *searchPrecision >= 1 {
+			exUsage("searchPrecision must be between 0.0 and 1.0")
+		}
+		if *minAchieved <= 0 || *minAchieved > 1 {
+			exUsage("minAchieved must be greater than 0.0 and at most 1.0")
+		}
+	}
+
+	if *rate == 0 && *qps < 1 {
 		exUsage("qps must be at least 1")
 	}
 
@@ -350,6 +541,34 @@ func main() {
 		exUsage("concurrency must be at least 1")
 	}
 
+	if *mode != "closed" && *mode != "open" && *mode != "pool" && *mode != "churn" {
+		exUsage("mode should be [closed | open | pool | churn].")
+	}
+
+	if *mode == "pool" && *maxInFlight < 1 {
+		exUsage("pool mode requires max-inflight to be at least 1")
+	}
+
+	if *mode != "pool" && *maxInFlight != 0 {
+		exUsage("max-inflight is only supported in pool mode")
+	}
+
+	if *learnHash < 0 {
+		exUsage("learnHash must not be negative")
+	}
+
+	if *maxConnRequests < 0 || *maxConnAge < 0 {
+		exUsage("maxConnRequests and maxConnAge must not be negative")
+	}
+
+	if *churnRequests < 1 {
+		exUsage("churnRequests must be at least 1")
+	}
+
+	if *mode == "churn" && *maxConnRequests != 0 {
+		exUsage("maxConnRequests cannot be set in churn mode, use churnRequests")
+	}
+
 	latencyDur := time.Millisecond
 	if *latencyUnit == "ms" {
 		latencyDur = time.Millisecond
@@ -361,38 +580,143 @@ func main() {
 		exUsage("latency unit should be [ms | us | ns].")
 	}
 	latencyDurNS := latencyDur.Nanoseconds()
-	msInNS := time.Millisecond.Nanoseconds()
-	usInNS := time.Microsecond.Nanoseconds()
+	measures, err := parseLatencyMeasures(*latencySpec)
+	if err != nil {
+		exUsage("invalid latency: %s", err.Error())
+	}
 
 	hosts := strings.Split(*host, ",")
 
 	requestData := loadData(*data)
+	headers, err := headerValues.load()
+	if err != nil {
+		exUsage(err.Error())
+	}
+	// The url list, headers and data can be reloaded while we run, so
+	// request threads pick up the latest source for every request.
+	var source atomic.Value
+	source.Store(&requestSource{urls: dstURLs, headers: headers, data: requestData})
 
 	iteration := uint64(0)
 
-	// Response tracking metadata.
-	count := uint64(0)
-	size := uint64(0)
-	good := uint64(0)
-	bad := uint64(0)
-	failed := uint64(0)
-	min := int64(math.MaxInt64)
-	max := int64(0)
-	failedHashCheck := int64(0)
-
 	// dayInTimeUnits represents the number of time units (ms, us, or ns) in a 24-hour day.
 	dayInTimeUnits := int64(24 * time.Hour / latencyDur)
 
-	hist := hdrhistogram.New(0, dayInTimeUnits, 3)
+	// Response tracking metadata for the current interval. Burst requests
+	// are kept apart from the baseline load.
+	newStats := func() *intervalStats {
+		return newIntervalStats(dayInTimeUnits, *mode == "pool", *burstSize > 0, len(measures) > 1)
+	}
+	stats := newStats()
 	globalHist := hdrhistogram.New(0, dayInTimeUnits, 3)
+	globalBurstHist := hdrhistogram.New(0, dayInTimeUnits, 3)
+	// Results can also be broken down by groups of urls.
+	var urlGroups *urlTable
+	if *perURL != "" {
+		urlGroups, err = newURLTable(*perURL, dayInTimeUnits)
+		if err != nil {
+			exUsage("invalid perURL: %s", err.Error())
+		}
+	}
+	var globalStageHists [numStages]*hdrhistogram.Histogram
+	for stage := range globalStageHists {
+		globalStageHists[stage] = hdrhistogram.New(0, dayInTimeUnits, 3)
+	}
+	// Totals of how well the request threads kept to their schedule.
+	totalSent := uint64(0)
+	totalSkipped := uint64(0)
+	maxLag := int64(0)
+	totalCodes := make(map[int]uint64)
+	totalErrors := make(map[string]uint64)
+	var totalCheckFailures [maxChecks]uint64
 	latencyHistory := ring.New(5)
-	received := make(chan *MeasuredResponse)
 	timeout := time.After(*interval)
-	timeToWait := CalcTimeToWait(qps)
-	var totalTrafficTarget int
-	totalTrafficTarget = *qps * *concurrency * int(interval.Seconds())
+	// The target rate is spread evenly across all request threads.
+	var loadProfile profile.Profile
+	if *profileSpec != "" {
+		p, err := profile.Parse(*profileSpec)
+		if err != nil {
+			exUsage("invalid profile: %s", err.Error())
+		}
+		loadProfile = p
+	} else if *rate > 0 {
+		loadProfile = profile.Constant(*rate)
+	} else {
+		loadProfile = profile.Constant(float64(*qps * *concurrency))
+	}
+	arrivalProcess, err := arrival.Parse(*arrivalSpec)
+	if err != nil {
+		exUsage("invalid arrival process: %s", err.Error())
+	}
 
-	client := newClient(*compress, *noreuse, *concurrency, *clientTimeout)
+	// Warmup and cooldown are measured from either end of the run, so a
+	// cooldown needs to know when the run will end.
+	runLength := time.Duration(0)
+	if *numIterations > 0 {
+		runLength = time.Duration(*numIterations) * *interval
+	}
+	if *duration > 0 && (runLength == 0 || *duration < runLength) {
+		runLength = *duration
+	}
+	if d := loadProfile.Duration(); d > 0 && (runLength == 0 || d < runLength) {
+		runLength = d
+	}
+	if *warmup < 0 || *cooldown < 0 {
+		exUsage("warmup and cooldown must not be negative")
+	}
+	if *cooldown > 0 && runLength == 0 {
+		exUsage("cooldown requires a run of known length, set duration or iterations, or use a profile that ends")
+	}
+	if runLength > 0 && *warmup+*cooldown >= runLength {
+		exUsage("warmup and cooldown must be shorter than the run")
+	}
+
+	// A search runs each interval at a single rate and picks the rate of
+	// the next one from the results.
+	var search *capacitySearch
+	var searchProfile *profile.Adjustable
+	if *searchStrategy != "" {
+		startRate := loadProfile.Rate(0)
+		search = newCapacitySearch(*searchStrategy, startRate, *searchMaxRate, *searchPrecision)
+		searchProfile = profile.NewAdjustable(startRate)
+		loadProfile = searchProfile
+	}
+
+	maxConn := *concurrency
+	if *mode == "pool" {
+		maxConn = *maxInFlight
+	}
+	limits := connLimits{maxRequests: *maxConnRequests, maxAge: *maxConnAge}
+	client := newClient(*compress, *noreuse, maxConn, *clientTimeout, limits, *resumeTLS)
+	var hashes *hashCheck
+	if *hashSampleRate > 0.0 {
+		if *hashValue == "" && *hashManifest == "" && *learnHash == 0 {
+			exUsage("hashSampleRate requires hashValue, hashManifest or learnHash to be set")
+		}
+		if *learnHash != 0 && *hashValue != "" {
+			exUsage("learnHash can't be combined with hashValue")
+		}
+		hashes, err = newHashCheck(*hashAlgorithm, *hashSampleRate, *hashValue, *hashManifest, *learnHash, *mismatchDir)
+		if err != nil {
+			exUsage("invalid hash check: %s", err.Error())
+		}
+	} else if *learnHash != 0 || *mismatchDir != "" {
+		exUsage("learnHash and mismatchDir require hashSampleRate to be set")
+	}
+	checks, err := newResponseChecks(newClassifier(goodRules, badRules), hashes, asserts)
+	if err != nil {
+		exUsage("invalid assert: %s", err.Error())
+	}
+	// In churn mode each request thread has a connection of its own, which
+	// it replaces after sending churnRequests requests on it.
+	threadClients := make([]*http.Client, *concurrency)
+	for i := range threadClients {
+		threadClients[i] = client
+		if *mode == "churn" {
+			threadClients[i] = newClient(*compress, *noreuse, 1, *clientTimeout,
+				connLimits{maxRequests: *churnRequests, maxAge: *maxConnAge}, *resumeTLS)
+		}
+	}
 	var sendTraffic sync.WaitGroup
 	// The time portion of the header can change due to timezone.
 	timeLen := len(time.Now().Format(time.RFC3339))
@@ -400,70 +724,481 @@ func main() {
 	intLen := len(fmt.Sprintf("%s", *interval))
 	intPadding := strings.Repeat(" ", intLen-2)
 
+	sending := fmt.Sprintf("%s %s req/s", formatRate(loadProfile.Rate(0)), *method)
+	if *profileSpec != "" {
+		sending = fmt.Sprintf("%s req/s following profile %s", *method, *profileSpec)
+	}
 	if len(dstURLs) == 1 {
-		fmt.Printf("# sending %d %s req/s with concurrency=%d to %s ...\n", (*qps * *concurrency), *method, *concurrency, dstURLs[0])
+		fmt.Printf("# sending %s with concurrency=%d to %s ...\n", sending, *concurrency, dstURLs[0])
 	} else {
-		fmt.Printf("# sending %d %s req/s with concurrency=%d using url list %s ...\n", (*qps * *concurrency), *method, *concurrency, urldest[1:])
+		fmt.Printf("# sending %s with concurrency=%d using url list %s ...\n", sending, *concurrency, urldest[1:])
+	}
+	if *mode == "churn" && *profileSpec == "" {
+		fmt.Printf("# opening %s connections/s with %d requests each\n",
+			formatRate(loadProfile.Rate(0)/float64(*churnRequests)), *churnRequests)
 	}
 
-	fmt.Printf("# %s iter   good/b/f t   goal%% %s min [p50 p95 p99  p999]  max bhash change\n", timePadding, intPadding)
+	poolHeader := ""
+	if *mode == "pool" {
+		poolHeader = " qwait limited"
+	}
+	burstHeader := ""
+	if *burstSize > 0 {
+		burstHeader = " burst [bp50 bp99]  bmax"
+	}
+	altHeader := ""
+	if len(measures) > 1 {
+		altHeader = fmt.Sprintf(" %s [p50  p99]", measures[1])
+	}
+	// Each assertion gets a column counting the responses that failed it.
+	assertHeader := ""
+	for _, a := range asserts {
+		fmt.Printf("# assertion %s: %s\n", a.name(), a.spec)
+		assertHeader += fmt.Sprintf(" %5s", a.name())
+	}
+	fmt.Printf("# %s iter   good/b/f t   goal%% rate %s min [p50 p95 p99  p999]  max bhash   sent/intd    lag   done inflight  tmo      bytes    bytes/s    new/reused idle99  opened/closed resumed%s%s%s%s change\n", timePadding, intPadding, altHeader, poolHeader, burstHeader, assertHeader)
 	stride := *concurrency
 	if stride > len(dstURLs) {
 		stride = 1
 	}
+	// For each request we want to reuse a buffer for performance reasons.
+	bodyBuffers := sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, 50000)
+			return &b
+		},
+	}
+	var inFlight sync.WaitGroup
+	// In pool mode a request must take one of the slots before it is sent.
+	slots := make(chan struct{}, *maxInFlight)
+	limitHits := uint64(0)
+	// gaveUp is closed if outstanding requests aren't done within
+	// drainTimeout of traffic stopping.
+	gaveUp := make(chan struct{})
+	start := time.Now()
+	intervalStart := start
+	phases := newRunPhases(start, *warmup, *cooldown, runLength)
+	// Request threads record their results into one of several shards,
+	// which are merged at the end of every interval.
+	rec := newRecorder(4*runtime.GOMAXPROCS(0), newStats, latencyDur)
+	// send makes a request and records its result under key, which picks
+	// the shard it is recorded into.
+	send := func(client *http.Client, src *requestSource, dstURL *url.URL, id uint64, key uint64, intended time.Time, queueWait time.Duration, burst bool) {
+		phase := phases.at(time.Now())
+		bodyBuffer := bodyBuffers.Get().(*[]byte)
+		atomic.AddInt64(&inFlightCount, 1)
+		promInFlight.Inc()
+		resp := sendRequest(client, *method, dstURL, hosts[rand.Intn(len(hosts))], src.headers, src.data, id, intended, *noreuse, checks, *bodyBuffer)
+		atomic.AddInt64(&inFlightCount, -1)
+		promInFlight.Dec()
+		bodyBuffers.Put(bodyBuffer)
+		resp.queueWait = queueWait
+		resp.burst = burst
+		resp.phase = phase
+		for i, check := range checks.checks {
+			if resp.failedChecks&(1<<uint(i)) != 0 {
+				promCheckFailures.WithLabelValues(check.name()).Inc()
+			}
+		}
+		if urlGroups != nil {
+			resp.group = urlGroups.lookup(dstURL)
+		}
+		// The first latency measure drives the main histogram.
+		latency := latencyMeasures[measures[0]](&resp)
+		if len(measures) > 1 {
+			resp.altLatency = latencyMeasures[measures[1]](&resp)
+		}
+		resp.latency = latency
+		rec.record(key, &resp)
+	}
 	for i := 0; i < *concurrency; i++ {
-		ticker := time.NewTicker(timeToWait)
-		go func(offset int) {
+		// In closed mode each request thread waits for its response before
+		// sending again, so sends it can't keep up with are dropped. In
+		// open mode requests are dispatched on schedule whether or not
+		// earlier ones have completed; late requests go out immediately but
+		// keep their intended send time. In pool mode requests are also
+		// scheduled on time but queue for one of max-inflight slots, so
+		// concurrency adapts to the target's latency up to that limit.
+		// Churn mode is closed-loop, with every thread opening a new
+		// connection after each churnRequests requests.
+		pacer := newPacer(loadProfile, arrivalProcess, start, i, *concurrency, *mode == "closed" || *mode == "churn", finished)
+		sendTraffic.Add(1)
+		go func(thread uint64, offset int) {
+			defer sendTraffic.Done()
 			y := offset
-			// For each goroutine we want to reuse a buffer for performance reasons.
-			bodyBuffer := make([]byte, 50000)
-			sendTraffic.Add(1)
-			for _ = range ticker.C {
-				var checkHash bool
-				hasher := fnv.New64a()
-				if *hashSampleRate > 0.0 {
-					checkHash = shouldCheckHash(*hashSampleRate)
-				} else {
-					checkHash = false
+			for {
+				intended, ok := pacer.wait()
+				if !ok {
+					return
 				}
-				shouldFinishLock.RLock()
-				if !shouldFinish {
-					shouldFinishLock.RUnlock()
-					sendRequest(client, *method, dstURLs[y], hosts[rand.Intn(len(hosts))], headers, requestData, atomic.AddUint64(&reqID, 1), *noreuse, *hashValue, checkHash, hasher, received, bodyBuffer)
-				} else {
-					shouldFinishLock.RUnlock()
-					sendTraffic.Done()
+				// Stop exactly once the requested number of requests is sent.
+				id := atomic.AddUint64(&reqID, 1)
+				if *totalRequests != 0 && id > *totalRequests {
+					finishSendingTraffic()
 					return
 				}
+				// Record how far behind schedule the send is going out, and
+				// how many sends were dropped to get back on schedule.
+				key := id
+				if *mode == "closed" || *mode == "churn" {
+					key = thread
+				}
+				rec.dispatched(key, time.Since(intended), pacer.takeSkipped())
+				src := source.Load().(*requestSource)
+				dstURL := src.urls[y%len(src.urls)]
+				switch *mode {
+				case "open":
+					inFlight.Add(1)
+					go func() {
+						send(client, src, dstURL, id, id, intended, 0, false)
+						inFlight.Done()
+					}()
+				case "pool":
+					// Once it has an id the request must be sent, even if
+					// traffic stops while it waits for a slot, so that
+					// totalRequests are all sent.
+					select {
+					case slots <- struct{}{}:
+					default:
+						atomic.AddUint64(&limitHits, 1)
+						promLimitHits.Inc()
+						select {
+						case slots <- struct{}{}:
+						case <-gaveUp:
+							return
+						}
+					}
+					inFlight.Add(1)
+					queueWait := time.Since(intended)
+					go func() {
+						send(client, src, dstURL, id, id, time.Time{}, queueWait, false)
+						<-slots
+						inFlight.Done()
+					}()
+				default:
+					send(threadClients[thread], src, dstURL, id, key, time.Time{}, 0, false)
+				}
 				y += stride
-				if y >= len(dstURLs) {
+				if y >= len(src.urls) {
 					y = offset
 				}
 			}
-		}(i % len(dstURLs))
+		}(uint64(i), i%len(dstURLs))
 	}
 
-	cleanup := make(chan bool, 3)
+	// Every burstInterval, fire burstSize extra requests on top of the
+	// baseline load, either all at once or at burstRate. Like in open mode,
+	// their latency is measured from when they were meant to be sent.
+	if *burstSize > 0 {
+		sendTraffic.Add(1)
+		go func() {
+			defer sendTraffic.Done()
+			ticker := time.NewTicker(*burstInterval)
+			defer ticker.Stop()
+			y := 0
+			for {
+				var burstStart time.Time
+				select {
+				case <-finished:
+					return
+				case burstStart = <-ticker.C:
+				}
+				for i := 0; i < *burstSize; i++ {
+					intended := burstStart
+					if *burstRate > 0 {
+						intended = burstStart.Add(time.Duration(float64(i) * float64(time.Second) / *burstRate))
+						select {
+						case <-finished:
+							return
+						case <-time.After(time.Until(intended)):
+						}
+					}
+					id := atomic.AddUint64(&reqID, 1)
+					if *totalRequests != 0 && id > *totalRequests {
+						finishSendingTraffic()
+						return
+					}
+					src := source.Load().(*requestSource)
+					dstURL := src.urls[y%len(src.urls)]
+					y++
+					inFlight.Add(1)
+					go func() {
+						send(client, src, dstURL, id, id, intended, 0, true)
+						inFlight.Done()
+					}()
+				}
+			}
+		}()
+	}
+
+	cleanup := make(chan bool, 1)
 	interrupted := make(chan os.Signal, 2)
-	signal.Notify(interrupted, syscall.SIGINT)
+	signal.Notify(interrupted, syscall.SIGINT, syscall.SIGTERM)
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	if *metricAddr != "" {
-		registerMetrics()
+		registerMetrics(func() float64 {
+			return loadProfile.Rate(time.Since(start))
+		})
 		go func() {
 			http.Handle("/metrics", promhttp.Handler())
 			http.ListenAndServe(*metricAddr, nil)
 		}()
 	}
 
+	// A profile that ends also ends the run.
+	var profileDone <-chan time.Time
+	if d := loadProfile.Duration(); d > 0 {
+		profileDone = time.After(d)
+	}
+	var durationDone <-chan time.Time
+	if *duration > 0 {
+		durationDone = time.After(*duration)
+	}
+
+	// Once traffic stops, wait for outstanding requests to be answered, up
+	// to drainTimeout, and then report the last, partial, interval.
+	stopping := (<-chan struct{})(finished)
+	var drained chan struct{}
+	var drainDeadline <-chan time.Time
+
+	// printInterval prints stats about the request load for the interval
+	// ending at t.
+	printInterval := func(t time.Time, length time.Duration) {
+		// When all requests are failures, ensure we don't accidentally
+		// print out a monstrously huge number.
+		if stats.min == math.MaxInt64 {
+			stats.min = 0
+		}
+		// Periodically print stats about the request load. The goal is
+		// based on the rates the profile asked for during this interval,
+		// so it leaves out bursts.
+		totalTrafficTarget := profile.Target(loadProfile, intervalStart.Sub(start), t.Sub(start))
+		percentAchieved := 100
+		if totalTrafficTarget > 0 {
+			percentAchieved = int(math.Min((((float64(stats.good) + float64(stats.bad) - float64(stats.burstResponses)) /
+				totalTrafficTarget) * 100), 100))
+		}
+
+		lastP99 := int(stats.hist.ValueAtQuantile(99))
+		// We want the change indicator to be based on
+		// how far away the current value is from what
+		// we've seen historically. This is why we call
+		// CalculateChangeIndicator() first and then Push()
+		changeIndicator := window.CalculateChangeIndicator(latencyHistory.Items, lastP99)
+		latencyHistory.Push(lastP99)
+
+		// The second latency measure, if any, is reported alongside.
+		altStats := ""
+		if stats.altHist != nil {
+			altStats = fmt.Sprintf(" %s [%3d %4d]",
+				strings.Repeat(" ", len(measures[1])),
+				stats.altHist.ValueAtQuantile(50),
+				stats.altHist.ValueAtQuantile(99))
+		}
+
+		// In pool mode, report the p99 time requests queued for a slot and
+		// how often they had to.
+		poolStats := ""
+		if *mode == "pool" {
+			poolStats = fmt.Sprintf(" %5d %7d",
+				stats.queueHist.ValueAtQuantile(99),
+				atomic.SwapUint64(&limitHits, 0))
+		}
+
+		burstStats := ""
+		if *burstSize > 0 {
+			burstStats = fmt.Sprintf(" %5d [%4d %4d] %5d",
+				stats.burstResponses,
+				stats.burstHist.ValueAtQuantile(50),
+				stats.burstHist.ValueAtQuantile(99),
+				stats.burstHist.Max())
+		}
+
+		assertStats := ""
+		_, assertFailures := checks.assertions(&stats.checkFailures)
+		for _, n := range assertFailures {
+			assertStats += fmt.Sprintf(" %5d", n)
+		}
+
+		// Intervals with samples taken outside of steady state are
+		// marked, as those samples are left out of the summary.
+		phaseLabel := ""
+		if stats.phase != "" {
+			phaseLabel = " " + stats.phase
+		}
+
+		fmt.Printf("%s %4d %6d/%1d/%1d %d %3d%% %s %s %3d [%3d %3d %3d %4d ] %4d %6d %6d/%-6d %4d %6d %8d %4d %10d %10d %6d/%-6d %6d %6d/%-6d %7d%s%s%s%s %s codes=%s errors=%s%s\n",
+			t.Format(time.RFC3339),
+			iteration,
+			stats.good,
+			stats.bad,
+			stats.failed,
+			int(math.Round(totalTrafficTarget)),
+			percentAchieved,
+			formatRate(loadProfile.Rate(t.Sub(start))),
+			length,
+			stats.min,
+			stats.hist.ValueAtQuantile(50),
+			stats.hist.ValueAtQuantile(95),
+			stats.hist.ValueAtQuantile(99),
+			stats.hist.ValueAtQuantile(999),
+			stats.max,
+			checks.hashFailures(&stats.checkFailures),
+			stats.sent,
+			stats.sent+stats.skipped,
+			stats.maxLag,
+			stats.count,
+			atomic.LoadInt64(&inFlightCount),
+			stats.timeouts,
+			stats.size,
+			int64(float64(stats.size)/length.Seconds()),
+			stats.newConns,
+			stats.reusedConns,
+			stats.idleHist.ValueAtQuantile(99),
+			atomic.SwapUint64(&connsOpened, 0),
+			atomic.SwapUint64(&connsClosed, 0),
+			stats.tlsResumptions,
+			altStats,
+			poolStats,
+			burstStats,
+			assertStats,
+			changeIndicator,
+			formatCodes(stats.codes),
+			formatCounts(stats.errors),
+			phaseLabel)
+	}
+
+	// endInterval adds the steady state samples of the interval ending at
+	// t to the summary and starts the next interval.
+	endInterval := func(t time.Time) {
+		totalSent += stats.sent
+		totalSkipped += stats.skipped
+		for code, n := range stats.codes {
+			totalCodes[code] += n
+		}
+		addCounts(totalErrors, stats.errors)
+		for i, n := range stats.checkFailures {
+			totalCheckFailures[i] += n
+		}
+		if stats.maxLag > maxLag {
+			maxLag = stats.maxLag
+		}
+		globalHist.Merge(stats.steadyHist)
+		for stage, h := range stats.stageHists {
+			globalStageHists[stage].Merge(h)
+		}
+		if *burstSize > 0 {
+			globalBurstHist.Merge(stats.steadyBurstHist)
+		}
+		stats.reset()
+		intervalStart = t
+	}
+
+	// finishDraining reports the last, partial, interval if any responses
+	// arrived during it and moves on to the summary.
+	finishDraining := func() {
+		drained = nil
+		drainDeadline = nil
+		t := time.Now()
+		rec.collect(stats)
+		if stats.count > 0 {
+			printInterval(t, t.Sub(intervalStart).Round(time.Millisecond))
+			if urlGroups != nil {
+				urlGroups.printInterval(os.Stdout, stats)
+			}
+		}
+		endInterval(t)
+		cleanup <- true
+	}
+
 	for {
 		select {
-		// If we get a SIGINT, then start the shutdown process.
+		// If we get a SIGINT or SIGTERM, then start the shutdown process. If
+		// we get another while waiting for outstanding requests, stop
+		// waiting.
 		case <-interrupted:
-			cleanup <- true
-		case <-cleanup:
+			if stopping != nil {
+				finishSendingTraffic()
+			} else if drained != nil {
+				fmt.Fprintf(os.Stderr, "stopped waiting for %d outstanding requests\n",
+					atomic.LoadInt64(&inFlightCount))
+				finishDraining()
+			}
+		// On SIGUSR1, report on the run so far and keep going.
+		case <-dump:
+			rec.collect(stats)
+			summary := hdrhistogram.Import(globalHist.Export())
+			summary.Merge(stats.steadyHist)
+			fmt.Printf("# latency summary at %s\n", time.Now().Format(time.RFC3339))
+			hdrreport.PrintLatencySummary(summary)
+			if *reportLatenciesCSV != "" {
+				err := hdrreport.WriteReportCSV(reportLatenciesCSV, summary)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to write Latency CSV file: %v\n", err)
+				}
+			}
+		// On SIGHUP, reread the url list, headers and data from their files.
+		case <-reload:
+			next, err := reloadRequestSource(source.Load().(*requestSource), urldest, headerValues, *data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to reload: %v\n", err)
+				continue
+			}
+			source.Store(next)
+			fmt.Printf("# reloaded %d urls, %d headers and %d bytes of data\n",
+				len(next.urls), len(next.headers), len(next.data))
+		case <-profileDone:
+			finishSendingTraffic()
+		case <-durationDone:
 			finishSendingTraffic()
+		case <-stopping:
+			stopping = nil
+			drained = make(chan struct{})
+			go func() {
+				sendTraffic.Wait()
+				inFlight.Wait()
+				close(drained)
+			}()
+			drainDeadline = time.After(*drainTimeout)
+		case <-drained:
+			finishDraining()
+		case <-drainDeadline:
+			close(gaveUp)
+			fmt.Fprintf(os.Stderr, "gave up waiting for %d outstanding requests after %s\n",
+				atomic.LoadInt64(&inFlightCount), *drainTimeout)
+			finishDraining()
+		case <-cleanup:
+			if search != nil {
+				search.printResults(os.Stdout, *latencyUnit)
+			}
 			if !*noLatencySummary {
+				fmt.Printf("# sent %d of %d intended requests, %d skipped, max scheduler lag %d%s\n",
+					totalSent, totalSent+totalSkipped, totalSkipped, maxLag, *latencyUnit)
+				fmt.Printf("# responses by status code: %s\n", formatCodes(totalCodes))
+				fmt.Printf("# failures by error: %s\n", formatCounts(totalErrors))
+				if len(asserts) > 0 {
+					fmt.Printf("# failed assertions: %s\n", formatAssertionFailures(checks.assertions(&totalCheckFailures)))
+				}
+				fmt.Println("# latency summary")
 				hdrreport.PrintLatencySummary(globalHist)
+				if *burstSize > 0 {
+					fmt.Println("# burst latency summary")
+					hdrreport.PrintLatencySummary(globalBurstHist)
+				}
+				if urlGroups != nil {
+					fmt.Println("# per-url latency summary")
+					urlGroups.printSummary(os.Stdout, *latencyUnit)
+				}
+				for stage, h := range globalStageHists {
+					if *stageSummary && h.TotalCount() > 0 {
+						fmt.Printf("# %s latency summary\n", stageNames[stage])
+						hdrreport.PrintLatencySummary(h)
+					}
+				}
 			}
 			if *reportLatenciesCSV != "" {
 				err := hdrreport.WriteReportCSV(reportLatenciesCSV, globalHist)
@@ -471,102 +1206,45 @@ func main() {
 					log.Panicf("Unable to write Latency CSV file: %v\n", err)
 				}
 			}
-			go func() {
-				// Don't Wait() in the event loop or else we'll block the workers
-				// from draining.
-				sendTraffic.Wait()
-				os.Exit(0)
-			}()
+			os.Exit(0)
 		case t := <-timeout:
-			// When all requests are failures, ensure we don't accidentally
-			// print out a monstrously huge number.
-			if min == math.MaxInt64 {
-				min = 0
+			rec.collect(stats)
+			printInterval(t, *interval)
+			if urlGroups != nil {
+				urlGroups.printInterval(os.Stdout, stats)
 			}
-			// Periodically print stats about the request load.
-			percentAchieved := int(math.Min((((float64(good) + float64(bad)) /
-				float64(totalTrafficTarget)) * 100), 100))
-
-			lastP99 := int(hist.ValueAtQuantile(99))
-			// We want the change indicator to be based on
-			// how far away the current value is from what
-			// we've seen historically. This is why we call
-			// CalculateChangeIndicator() first and then Push()
-			changeIndicator := window.CalculateChangeIndicator(latencyHistory.Items, lastP99)
-			latencyHistory.Push(lastP99)
-
-			fmt.Printf("%s %4d %6d/%1d/%1d %d %3d%% %s %3d [%3d %3d %3d %4d ] %4d %6d %s\n",
-				t.Format(time.RFC3339),
-				iteration,
-				good,
-				bad,
-				failed,
-				totalTrafficTarget,
-				percentAchieved,
-				interval,
-				min,
-				hist.ValueAtQuantile(50),
-				hist.ValueAtQuantile(95),
-				hist.ValueAtQuantile(99),
-				hist.ValueAtQuantile(999),
-				max,
-				failedHashCheck,
-				changeIndicator)
-
 			iteration++
 
-			if *numIterations > 0 && iteration >= *numIterations {
-				cleanup <- true
-			}
-			count = 0
-			size = 0
-			good = 0
-			bad = 0
-			min = math.MaxInt64
-			max = 0
-			failed = 0
-			failedHashCheck = 0
-			hist.Reset()
-			timeout = time.After(*interval)
-
-			if *totalRequests != 0 && reqID > *totalRequests {
-				cleanup <- true
-			}
-		case managedResp := <-received:
-			count++
-			promRequests.Inc()
-			if managedResp.err != nil {
-				fmt.Fprintln(os.Stderr, managedResp.err)
-				failed++
-			} else {
-				respLatencyNS := managedResp.latency.Nanoseconds()
-				latency := respLatencyNS / latencyDurNS
-
-				size += managedResp.sz
-				if managedResp.failedHashCheck {
-					failedHashCheck++
-				}
-				if managedResp.code >= 200 && managedResp.code < 500 {
-					good++
-					promSuccesses.Inc()
-					promLatencyMSHistogram.Observe(float64(respLatencyNS / msInNS))
-					promLatencyUSHistogram.Observe(float64(respLatencyNS / usInNS))
-					promLatencyNSHistogram.Observe(float64(respLatencyNS))
-				} else {
-					bad++
+			if search != nil {
+				errorRate := 1.0
+				if stats.count > 0 {
+					errorRate = float64(stats.bad+stats.failed) / float64(stats.count)
 				}
-
-				if latency < min {
-					min = latency
+				// A step only passes if its rate was actually sent.
+				achieved := 1.0
+				if target := profile.Target(loadProfile, intervalStart.Sub(start), t.Sub(start)); target > 0 {
+					achieved = math.Min(float64(stats.sent)/target, 1)
 				}
-
-				if latency > max {
-					max = latency
+				next, more := search.record(searchStep{
+					rate:      searchProfile.Rate(0),
+					p99:       stats.hist.ValueAtQuantile(99),
+					errorRate: errorRate,
+					achieved:  achieved,
+					passed: stats.hist.ValueAtQuantile(99) <= maxP99.Nanoseconds()/latencyDurNS &&
+						errorRate <= *maxErrorRate && achieved >= *minAchieved,
+				})
+				if more {
+					searchProfile.Set(next)
+				} else {
+					finishSendingTraffic()
 				}
+			}
 
-				hist.RecordValue(latency)
-				globalHist.RecordValue(latency)
+			if *numIterations > 0 && iteration >= *numIterations {
+				finishSendingTraffic()
 			}
+			endInterval(t)
+			timeout = time.After(*interval)
 		}
 	}
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mainArgsEnv holds the newline separated arguments to run main with when
+// the test binary is started by runMain.
+const mainArgsEnv = "SLOW_COOKER_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(mainArgsEnv); args != "" {
+		os.Args = append([]string{"slow_cooker"}, strings.Split(args, "\n")...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs slow_cooker with args in a process of its own, as main
+// exits when it's done, and returns what it printed.
+func runMain(t *testing.T, args ...string) (stdout string, stderr string) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	var out, errOut bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("slow_cooker %s failed: %v\n%s", strings.Join(args, " "), err, errOut.String())
+		}
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("slow_cooker %s didn't exit", strings.Join(args, " "))
+	}
+	return out.String(), errOut.String()
+}
+
+// countingServer returns a server that answers after delay, or once the
+// request is abandoned, and counts the requests it gets.
+func countingServer(delay time.Duration) (*httptest.Server, *uint64) {
+	var requests uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("ok"))
+	}))
+	return server, &requests
+}
+
+var sentSummary = regexp.MustCompile(`# sent (\d+) of (\d+) intended requests`)
+
+// sentRequests returns the number of requests the summary says were sent.
+func sentRequests(t *testing.T, stdout string) uint64 {
+	m := sentSummary.FindStringSubmatch(stdout)
+	if m == nil {
+		t.Fatalf("Expected a summary of requests sent, instead got\n%s", stdout)
+	}
+	sent, _ := strconv.ParseUint(m[1], 10, 64)
+	return sent
+}
+
+func TestTotalRequestsAreSentExactly(t *testing.T) {
+	// Many threads sharing few slots leave requests waiting for a slot
+	// when the last one is claimed, and they must still be sent.
+	for _, mode := range []string{"closed", "open", "pool"} {
+		server, requests := countingServer(20 * time.Millisecond)
+		args := []string{"-mode", mode, "-concurrency", "8", "-qps", "50", "-totalRequests", "25"}
+		if mode == "pool" {
+			args = append(args, "-max-inflight", "2")
+		}
+		stdout, _ := runMain(t, append(args, server.URL)...)
+		server.Close()
+
+		if got := atomic.LoadUint64(requests); got != 25 {
+			t.Errorf("Expected %s mode to send 25 requests, instead the server got %d", mode, got)
+		}
+		if sent := sentRequests(t, stdout); sent != 25 {
+			t.Errorf("Expected %s mode to report 25 requests sent, instead got %d", mode, sent)
+		}
+		if !strings.Contains(stdout, "# responses by status code: 200:25") {
+			t.Errorf("Expected %s mode to record 25 responses, instead got\n%s", mode, stdout)
+		}
+	}
+}
+
+// poolColumns matches the qwait and limited columns at the end of an
+// interval line in pool mode.
+var poolColumns = regexp.MustCompile(`(?m) (\d+) +(\d+) +[+-]? +codes=`)
+
+func TestPoolModeCapsRequestsInFlight(t *testing.T) {
+	var inFlight, maxInFlight int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// 8 threads at 50 req/s each want 400 req/s, but 2 slots held for 50ms
+	// each only let 40 req/s through.
+	stdout, _ := runMain(t, "-mode", "pool", "-concurrency", "8", "-max-inflight", "2", "-qps", "50",
+		"-totalRequests", "40", "-interval", "500ms", server.URL)
+	if max := atomic.LoadInt64(&maxInFlight); max > 2 {
+		t.Errorf("Expected at most 2 requests in flight, instead the server saw %d", max)
+	}
+	intervals := poolColumns.FindAllStringSubmatch(stdout, -1)
+	if len(intervals) == 0 {
+		t.Fatalf("Expected interval lines with pool columns, instead got\n%s", stdout)
+	}
+	var maxQueueWait, limitHits uint64
+	for _, columns := range intervals {
+		queueWait, _ := strconv.ParseUint(columns[1], 10, 64)
+		if queueWait > maxQueueWait {
+			maxQueueWait = queueWait
+		}
+		hits, _ := strconv.ParseUint(columns[2], 10, 64)
+		limitHits += hits
+	}
+	if maxQueueWait == 0 {
+		t.Errorf("Expected requests to queue for a slot, instead got\n%s", stdout)
+	}
+	if limitHits == 0 {
+		t.Errorf("Expected the limit to be hit, instead got\n%s", stdout)
+	}
+}
+
+func TestDurationStopsTraffic(t *testing.T) {
+	server, requests := countingServer(0)
+	defer server.Close()
+
+	before := time.Now()
+	stdout, _ := runMain(t, "-qps", "20", "-duration", "500ms", server.URL)
+	if took := time.Since(before); took > 5*time.Second {
+		t.Errorf("Expected a 500ms run to end soon after, instead it took %s", took)
+	}
+	// 20 req/s for 500ms is about 10 requests.
+	if got := atomic.LoadUint64(requests); got < 5 || got > 15 {
+		t.Errorf("Expected about 10 requests, instead the server got %d", got)
+	}
+	if sent := sentRequests(t, stdout); sent != atomic.LoadUint64(requests) {
+		t.Errorf("Expected the %d requests the server got to be reported sent, instead got %d", atomic.LoadUint64(requests), sent)
+	}
+}
+
+func TestDrainWaitsForResponses(t *testing.T) {
+	// Traffic stops once the last request is sent, well before its
+	// response comes back.
+	server, _ := countingServer(300 * time.Millisecond)
+	defer server.Close()
+
+	stdout, _ := runMain(t, "-mode", "open", "-qps", "20", "-totalRequests", "3", server.URL)
+	if !strings.Contains(stdout, "# responses by status code: 200:3") {
+		t.Errorf("Expected all 3 responses to be recorded, instead got\n%s", stdout)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	server, _ := countingServer(time.Minute)
+	defer server.Close()
+
+	before := time.Now()
+	_, stderr := runMain(t, "-mode", "pool", "-max-inflight", "1", "-concurrency", "2", "-qps", "20",
+		"-totalRequests", "2", "-drainTimeout", "200ms", server.URL)
+	if took := time.Since(before); took > 5*time.Second {
+		t.Errorf("Expected to give up on outstanding requests after 200ms, instead it took %s", took)
+	}
+	if !strings.Contains(stderr, "gave up waiting for 1 outstanding requests after 200ms") {
+		t.Errorf("Expected to give up on the outstanding request, instead got\n%s", stderr)
+	}
+}
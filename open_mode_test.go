@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLatencyMeasuredFromIntendedTime(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	client := newClient(false, false, 1, time.Second, connLimits{}, false)
+
+	// A request that was due 100ms ago has been queued for at least that long.
+	lag := 100 * time.Millisecond
+	resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 1, time.Now().Add(-lag), false, nil, make([]byte, 512))
+	if resp.err != nil {
+		t.Fatal(resp.err)
+	}
+	if resp.latency < lag {
+		t.Errorf("Expected latency of at least %s, instead got %s", lag, resp.latency)
+	}
+
+	// Without an intended time, latency only covers the request itself.
+	resp = sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 2, time.Time{}, false, nil, make([]byte, 512))
+	if resp.err != nil {
+		t.Fatal(resp.err)
+	}
+	if resp.latency >= lag {
+		t.Errorf("Expected latency under %s, instead got %s", lag, resp.latency)
+	}
+}
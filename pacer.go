@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/buoyantio/slow_cooker/arrival"
+	"github.com/buoyantio/slow_cooker/profile"
+)
+
+// idleWait is how long a pacer waits before checking the rate again when
+// its profile asks for no traffic, or at most before checking it again
+// during a long gap.
+const idleWait = 100 * time.Millisecond
+
+// batchWindow is how close a send must be to being due for a pacer to
+// release it without sleeping. Timers aren't much more precise than this,
+// and at high rates sleeping for every send costs more than the sends.
+const batchWindow = time.Millisecond
+
+// pacer works out when a request thread should send its next request so
+// that, together with the other request threads, it follows the rate of
+// a load profile. The gaps between requests come from an arrival process.
+// Each thread has a pacer of its own. A send due within batchWindow is
+// released without sleeping, so that at high rates a pacer releases a
+// run of sends for each time its timer fires.
+type pacer struct {
+	profile profile.Profile
+	arrival arrival.Process
+	start   time.Time
+	threads int
+	// skipMissed drops sends that are overdue by more than a full period,
+	// as a time.Ticker does, instead of sending all of them late.
+	skipMissed bool
+	// stop is closed when no more sends should be made.
+	stop  <-chan struct{}
+	next  time.Time
+	timer *time.Timer
+	// left is how much of the gap to the next send hasn't been waited yet,
+	// as a multiple of the mean gap. drawn is false until the gap is drawn
+	// from the arrival process.
+	left  float64
+	drawn bool
+	// skipped counts the sends dropped since takeSkipped was last called.
+	skipped uint64
+}
+
+// newPacer returns the pacer of request thread thread of threads. Each
+// thread's first send is offset by its share of the mean gap, so that
+// together the threads send at the rate rather than all at once.
+func newPacer(p profile.Profile, a arrival.Process, start time.Time, thread int, threads int, skipMissed bool, stop <-chan struct{}) *pacer {
+	return &pacer{
+		profile:    p,
+		arrival:    a,
+		start:      start,
+		threads:    threads,
+		skipMissed: skipMissed,
+		stop:       stop,
+		next:       start,
+		left:       float64(thread) / float64(threads),
+		drawn:      true,
+	}
+}
+
+// wait blocks until the next send is due and returns the time it was due.
+// It returns false if the pacer was stopped first. Gaps longer than
+// idleWait are waited a part at a time, reading the rate again after
+// each part, so that a rate ramping up from a low one is followed.
+func (p *pacer) wait() (time.Time, bool) {
+	for {
+		rate := p.profile.Rate(p.next.Sub(p.start)) / float64(p.threads)
+		if rate <= 0 {
+			p.next = p.next.Add(idleWait)
+			if !p.sleepUntilNext() {
+				return time.Time{}, false
+			}
+			continue
+		}
+		mean := CalcTimeToWaitForRate(rate)
+		if !p.drawn {
+			p.left = float64(p.arrival.Gap(mean)) / float64(mean)
+			p.drawn = true
+		}
+		wait := time.Duration(math.Round(p.left * float64(mean)))
+		if wait > idleWait {
+			p.left -= float64(idleWait) / float64(mean)
+			p.next = p.next.Add(idleWait)
+			if !p.sleepUntilNext() {
+				return time.Time{}, false
+			}
+			continue
+		}
+		p.next = p.next.Add(wait)
+		p.drawn = false
+		// Sends are only missed once they're a whole mean gap behind, as a
+		// random gap can be far shorter than the time a response takes.
+		if behind := time.Since(p.next); p.skipMissed && behind > mean {
+			missed := behind / mean
+			p.next = p.next.Add(missed * mean)
+			p.skipped += uint64(missed)
+		}
+		if !p.sleepUntilNext() {
+			return time.Time{}, false
+		}
+		return p.next, true
+	}
+}
+
+// sleepUntilNext sleeps until the next send is due, returning false if
+// the pacer was stopped first.
+func (p *pacer) sleepUntilNext() bool {
+	if wait := time.Until(p.next); wait > batchWindow {
+		if p.timer == nil {
+			p.timer = time.NewTimer(wait)
+		} else {
+			p.timer.Reset(wait)
+		}
+		select {
+		case <-p.stop:
+			p.timer.Stop()
+			return false
+		case <-p.timer.C:
+		}
+	}
+	select {
+	case <-p.stop:
+		return false
+	default:
+		return true
+	}
+}
+
+// takeSkipped returns the number of sends dropped for being overdue since
+// it was last called.
+func (p *pacer) takeSkipped() uint64 {
+	skipped := p.skipped
+	p.skipped = 0
+	return skipped
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buoyantio/slow_cooker/arrival"
+	"github.com/buoyantio/slow_cooker/profile"
+)
+
+func TestPacerSpreadsRateAcrossThreads(t *testing.T) {
+	start := time.Now()
+	// 200 req/s over 2 threads is 100 req/s, or one every 10ms, per thread,
+	// with the second thread 5ms behind the first.
+	for thread, offset := range []time.Duration{0, 5 * time.Millisecond} {
+		p := newPacer(profile.Constant(200), arrival.Uniform{}, start, thread, 2, false, nil)
+		for i := 0; i < 3; i++ {
+			expected := start.Add(offset + time.Duration(i)*10*time.Millisecond)
+			if got, _ := p.wait(); !got.Equal(expected) {
+				t.Errorf("Expected send %d of thread %d at %s, instead got %s", i, thread, expected.Sub(start), got.Sub(start))
+			}
+		}
+	}
+}
+
+func TestPacerSpreadsLowRates(t *testing.T) {
+	// At 2 req/s over 4 threads each thread sends every 2s, half a second
+	// apart, rather than all 4 at once.
+	start := time.Now().Add(-time.Hour)
+	for thread := 0; thread < 4; thread++ {
+		p := newPacer(profile.Constant(2), arrival.Uniform{}, start, thread, 4, false, nil)
+		expected := start.Add(time.Duration(thread) * 500 * time.Millisecond)
+		if got, _ := p.wait(); !got.Equal(expected) {
+			t.Errorf("Expected thread %d to first send at %s, instead got %s", thread, expected.Sub(start), got.Sub(start))
+		}
+	}
+}
+
+func TestPacerSkipsMissedSends(t *testing.T) {
+	start := time.Now().Add(-time.Second)
+	// At 100 req/s we are 100 sends behind. A closed-loop pacer sends once
+	// and then gets back on schedule, an open-loop pacer sends every one
+	// of them late.
+	closed := newPacer(profile.Constant(100), arrival.Uniform{}, start, 0, 1, true, nil)
+	closed.wait()
+	if got, _ := closed.wait(); time.Since(got) > 10*time.Millisecond {
+		t.Errorf("Expected a closed-loop pacer to skip missed sends, instead it is %s behind", time.Since(got))
+	}
+	if skipped := closed.takeSkipped(); skipped < 98 || skipped > 100 {
+		t.Errorf("Expected about 99 skipped sends, instead got %d", skipped)
+	}
+	if skipped := closed.takeSkipped(); skipped != 0 {
+		t.Errorf("Expected skipped sends to be reset once taken, instead got %d", skipped)
+	}
+	open := newPacer(profile.Constant(100), arrival.Uniform{}, start, 0, 1, false, nil)
+	open.wait()
+	if got, _ := open.wait(); !got.Equal(start.Add(10 * time.Millisecond)) {
+		t.Errorf("Expected an open-loop pacer to keep its schedule, instead it is %s behind", time.Since(got))
+	}
+	if skipped := open.takeSkipped(); skipped != 0 {
+		t.Errorf("Expected an open-loop pacer to skip nothing, instead it skipped %d", skipped)
+	}
+}
+
+func TestPacerStops(t *testing.T) {
+	// At 0.1 req/s the next send is 10s away, but stopping returns at once.
+	stop := make(chan struct{})
+	p := newPacer(profile.Constant(0.1), arrival.Uniform{}, time.Now(), 0, 1, false, stop)
+	close(stop)
+	before := time.Now()
+	if _, ok := p.wait(); ok {
+		t.Errorf("Expected a stopped pacer not to send")
+	}
+	if waited := time.Since(before); waited > time.Second {
+		t.Errorf("Expected a stopped pacer to return at once, instead it waited %s", waited)
+	}
+}
+
+func TestPacerFollowsArrivalProcess(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	// Gaps drawn from samples of 1 and 3 scale to 5ms and 15ms at 100 req/s.
+	empirical, _ := arrival.NewEmpirical([]float64{1, 3})
+	p := newPacer(profile.Constant(100), empirical, start, 0, 1, false, nil)
+	last, _ := p.wait()
+	for i := 0; i < 100; i++ {
+		next, _ := p.wait()
+		if gap := next.Sub(last); gap != 5*time.Millisecond && gap != 15*time.Millisecond {
+			t.Fatalf("Expected gaps of 5ms or 15ms, instead got %s", gap)
+		}
+		last = next
+	}
+}
+
+func TestPacerBatchesCloseSends(t *testing.T) {
+	// At 100k req/s sends are 10us apart, well inside the batch window,
+	// but none is released more than a batch window early.
+	start := time.Now()
+	p := newPacer(profile.Constant(100000), arrival.Uniform{}, start, 0, 1, false, nil)
+	for i := 0; i < 1000; i++ {
+		intended, _ := p.wait()
+		if early := time.Until(intended); early > batchWindow {
+			t.Fatalf("Expected send %d no more than %s early, instead it was %s early", i, batchWindow, early)
+		}
+	}
+	// The first send is due at the start and the last 9.99ms after it.
+	if elapsed := time.Since(start); elapsed < 9990*time.Microsecond-batchWindow {
+		t.Errorf("Expected 1000 sends to take about 10ms, instead they took %s", elapsed)
+	}
+}
+
+func TestPacerFollowsRampFromLowRate(t *testing.T) {
+	// Spread over 10 threads the ramp starts at 0.1 req/s, a 10s gap, but
+	// it is at 100 req/s per thread within a second.
+	start := time.Now().Add(-time.Hour)
+	p := newPacer(profile.Ramp{From: 1, To: 1000, Over: time.Second}, arrival.Uniform{}, start, 0, 10, false, nil)
+	first, _ := p.wait()
+	if due := first.Sub(start); due > 300*time.Millisecond {
+		t.Errorf("Expected the first send to follow the ramp up, instead it was due after %s", due)
+	}
+	var sends int
+	for next := first; next.Sub(start) < 2*time.Second; next, _ = p.wait() {
+		sends++
+	}
+	// About 50 sends on the ramp and 100 after it.
+	if sends < 140 || sends > 160 {
+		t.Errorf("Expected about 150 sends in the first 2s, instead got %d", sends)
+	}
+}
+
+// zeroGaps is an arrival process whose gaps are all zero.
+type zeroGaps struct{}
+
+func (zeroGaps) Gap(time.Duration) time.Duration {
+	return 0
+}
+
+func TestPacerHandlesZeroGaps(t *testing.T) {
+	// Zero gaps are sends due at once, not missed ones.
+	start := time.Now()
+	p := newPacer(profile.Constant(100), zeroGaps{}, start, 0, 1, true, nil)
+	for i := 0; i < 3; i++ {
+		if got, ok := p.wait(); !ok || !got.Equal(start) {
+			t.Errorf("Expected send %d to be due at the start, instead it was due %s after", i, got.Sub(start))
+		}
+	}
+	if skipped := p.takeSkipped(); skipped != 0 {
+		t.Errorf("Expected no skipped sends, instead got %d", skipped)
+	}
+}
+
+func TestPacerSkipsWholeMeanGaps(t *testing.T) {
+	// A closed-loop thread at 200 req/s whose responses take a fifth of a
+	// mean gap keeps up, even though many Poisson gaps are shorter.
+	p := newPacer(profile.Constant(200), arrival.Poisson{}, time.Now(), 0, 1, true, nil)
+	for i := 0; i < 100; i++ {
+		p.wait()
+		time.Sleep(time.Millisecond)
+	}
+	if skipped := p.takeSkipped(); skipped > 5 {
+		t.Errorf("Expected a thread that keeps up to skip few sends, instead it skipped %d", skipped)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+// runPhases splits a run into warmup, steady state and cooldown. Only
+// samples taken during steady state count toward the final summary.
+type runPhases struct {
+	warmupEnd time.Time
+	// cooldownStart is zero when there is no cooldown.
+	cooldownStart time.Time
+}
+
+func newRunPhases(start time.Time, warmup time.Duration, cooldown time.Duration, runLength time.Duration) runPhases {
+	phases := runPhases{warmupEnd: start.Add(warmup)}
+	if cooldown > 0 {
+		phases.cooldownStart = start.Add(runLength - cooldown)
+	}
+	return phases
+}
+
+// at returns the name of the phase the run is in at t, or "" for steady
+// state.
+func (p runPhases) at(t time.Time) string {
+	if t.Before(p.warmupEnd) {
+		return "warmup"
+	}
+	if !p.cooldownStart.IsZero() && !t.Before(p.cooldownStart) {
+		return "cooldown"
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunPhases(t *testing.T) {
+	start := time.Now()
+	// A 60s run with 15s of warmup and 10s of cooldown.
+	p := newRunPhases(start, 15*time.Second, 10*time.Second, time.Minute)
+
+	for _, c := range []struct {
+		at    time.Duration
+		phase string
+	}{
+		{0, "warmup"},
+		{14 * time.Second, "warmup"},
+		{15 * time.Second, ""},
+		{49 * time.Second, ""},
+		{50 * time.Second, "cooldown"},
+		{time.Hour, "cooldown"},
+	} {
+		if got := p.at(start.Add(c.at)); got != c.phase {
+			t.Errorf("At %s expected phase '%s', instead got '%s'", c.at, c.phase, got)
+		}
+	}
+
+	// Without warmup or cooldown, everything is steady state.
+	p = newRunPhases(start, 0, 0, 0)
+	if got := p.at(start); got != "" {
+		t.Errorf("Expected steady state at the start, instead got '%s'", got)
+	}
+	if got := p.at(start.Add(time.Hour)); got != "" {
+		t.Errorf("Expected steady state an hour in, instead got '%s'", got)
+	}
+}
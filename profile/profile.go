@@ -0,0 +1,350 @@
+package profile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Profile describes how the target request rate changes over a run.
+type Profile interface {
+	// Rate returns the target requests per second at the given time
+	// since the start of the run.
+	Rate(elapsed time.Duration) float64
+	// Duration returns how long the profile lasts, or 0 if it never ends.
+	Duration() time.Duration
+}
+
+// Constant is a Profile that never changes rate.
+type Constant float64
+
+// Rate returns the constant rate.
+func (c Constant) Rate(elapsed time.Duration) float64 {
+	return float64(c)
+}
+
+// Duration returns 0, a constant profile never ends.
+func (c Constant) Duration() time.Duration {
+	return 0
+}
+
+// Ramp is a Profile that changes linearly from one rate to another.
+type Ramp struct {
+	From float64
+	To   float64
+	Over time.Duration
+}
+
+// Rate returns the rate along the ramp.
+func (r Ramp) Rate(elapsed time.Duration) float64 {
+	if elapsed >= r.Over {
+		return r.To
+	}
+	if elapsed <= 0 {
+		return r.From
+	}
+	return r.From + (r.To-r.From)*float64(elapsed)/float64(r.Over)
+}
+
+// Duration returns the length of the ramp.
+func (r Ramp) Duration() time.Duration {
+	return r.Over
+}
+
+// Step holds a rate for a period of time.
+type Step struct {
+	Rate float64
+	Hold time.Duration
+}
+
+// Steps is a Profile that moves through a list of steps in order.
+type Steps []Step
+
+// Rate returns the rate of the step in effect.
+func (s Steps) Rate(elapsed time.Duration) float64 {
+	for _, step := range s {
+		if elapsed < step.Hold {
+			return step.Rate
+		}
+		elapsed -= step.Hold
+	}
+	if len(s) == 0 {
+		return 0
+	}
+	return s[len(s)-1].Rate
+}
+
+// Duration returns the sum of all hold durations.
+func (s Steps) Duration() time.Duration {
+	total := time.Duration(0)
+	for _, step := range s {
+		total += step.Hold
+	}
+	return total
+}
+
+// Sine is a Profile that oscillates smoothly between two rates. It starts
+// at Min and peaks at Max halfway through each period.
+type Sine struct {
+	Min    float64
+	Max    float64
+	Period time.Duration
+}
+
+// Rate returns the rate at the current point in the wave.
+func (s Sine) Rate(elapsed time.Duration) float64 {
+	phase := 2 * math.Pi * float64(elapsed%s.Period) / float64(s.Period)
+	return s.Min + (s.Max-s.Min)*(1-math.Cos(phase))/2
+}
+
+// Duration returns 0, a sine wave never ends.
+func (s Sine) Duration() time.Duration {
+	return 0
+}
+
+// diurnalLoad is the relative load for each hour of a typical day of
+// production traffic, starting at midnight.
+var diurnalLoad = []float64{
+	0.25, 0.15, 0.08, 0.03, 0.00, 0.02, 0.10, 0.30,
+	0.55, 0.75, 0.85, 0.90, 0.92, 0.90, 0.88, 0.90,
+	0.95, 1.00, 0.97, 0.90, 0.80, 0.65, 0.50, 0.35,
+}
+
+// Diurnal is a Profile that follows the shape of a day of production
+// traffic, quiet overnight and busiest in the early evening, compressed
+// into Period. It starts at midnight.
+type Diurnal struct {
+	Min    float64
+	Max    float64
+	Period time.Duration
+}
+
+// Rate returns the rate at the current time of day.
+func (d Diurnal) Rate(elapsed time.Duration) float64 {
+	hour := float64(len(diurnalLoad)) * float64(elapsed%d.Period) / float64(d.Period)
+	i := int(hour)
+	next := diurnalLoad[(i+1)%len(diurnalLoad)]
+	load := diurnalLoad[i] + (next-diurnalLoad[i])*(hour-float64(i))
+	return d.Min + (d.Max-d.Min)*load
+}
+
+// Duration returns 0, a diurnal profile never ends.
+func (d Diurnal) Duration() time.Duration {
+	return 0
+}
+
+// Square is a Profile that alternates between two rates, spending half
+// of each period at each.
+type Square struct {
+	Low    float64
+	High   float64
+	Period time.Duration
+}
+
+// Rate returns the rate for the current half of the period.
+func (s Square) Rate(elapsed time.Duration) float64 {
+	if elapsed%s.Period < s.Period/2 {
+		return s.Low
+	}
+	return s.High
+}
+
+// Duration returns 0, a square wave never ends.
+func (s Square) Duration() time.Duration {
+	return 0
+}
+
+// Adjustable is a Profile whose rate is changed while the run is in
+// progress. It is safe to use from multiple goroutines.
+type Adjustable struct {
+	bits uint64
+}
+
+// NewAdjustable returns an Adjustable starting at the given rate.
+func NewAdjustable(rate float64) *Adjustable {
+	a := &Adjustable{}
+	a.Set(rate)
+	return a
+}
+
+// Set changes the rate.
+func (a *Adjustable) Set(rate float64) {
+	atomic.StoreUint64(&a.bits, math.Float64bits(rate))
+}
+
+// Rate returns the rate most recently set.
+func (a *Adjustable) Rate(elapsed time.Duration) float64 {
+	return math.Float64frombits(atomic.LoadUint64(&a.bits))
+}
+
+// Duration returns 0, an adjustable profile ends when its user says so.
+func (a *Adjustable) Duration() time.Duration {
+	return 0
+}
+
+// targetSamples is the number of slices Target cuts a period into.
+const targetSamples = 1000
+
+// Target returns the number of requests a profile expects to be sent
+// between two points in a run.
+func Target(p Profile, from time.Duration, to time.Duration) float64 {
+	if to <= from {
+		return 0
+	}
+	// Integrate using the midpoint of each slice.
+	slice := float64(to-from) / targetSamples
+	total := 0.0
+	for i := 0; i < targetSamples; i++ {
+		mid := from + time.Duration(slice*(float64(i)+0.5))
+		total += p.Rate(mid)
+	}
+	return total * slice / float64(time.Second)
+}
+
+// Parse builds a Profile from its description. Supported descriptions are:
+//
+//	ramp:<from>:<to>:<duration>   linearly change the rate over duration
+//	step:<rate>,<rate>,...:<hold> hold each rate for the given duration
+//	sine:<min>:<max>:<period>     oscillate smoothly between two rates
+//	diurnal:<min>:<max>:<period>  follow a day of traffic compressed into period
+//	square:<low>:<high>:<period>  alternate between two rates
+//	@<path>                       read a schedule file, '@-' reads stdin
+func Parse(spec string) (Profile, error) {
+	if strings.HasPrefix(spec, "@") {
+		path := spec[1:]
+		if path == "-" {
+			return ReadSchedule(os.Stdin)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ReadSchedule(file)
+	}
+
+	parts := strings.Split(spec, ":")
+	switch parts[0] {
+	case "ramp":
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("ramp should be ramp:<from>:<to>:<duration>")
+		}
+		from, err := parseRate(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseRate(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		over, err := parseDuration(parts[3])
+		if err != nil {
+			return nil, err
+		}
+		return Ramp{From: from, To: to, Over: over}, nil
+	case "sine", "diurnal", "square":
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("%s should be %s:<min>:<max>:<period>", parts[0], parts[0])
+		}
+		min, err := parseRate(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		max, err := parseRate(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		period, err := parseDuration(parts[3])
+		if err != nil {
+			return nil, err
+		}
+		switch parts[0] {
+		case "sine":
+			return Sine{Min: min, Max: max, Period: period}, nil
+		case "diurnal":
+			return Diurnal{Min: min, Max: max, Period: period}, nil
+		default:
+			return Square{Low: min, High: max, Period: period}, nil
+		}
+	case "step":
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("step should be step:<rate>,<rate>,...:<hold>")
+		}
+		hold, err := parseDuration(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		var steps Steps
+		for _, r := range strings.Split(parts[1], ",") {
+			rate, err := parseRate(r)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, Step{Rate: rate, Hold: hold})
+		}
+		return steps, nil
+	default:
+		return nil, fmt.Errorf("unknown profile '%s'", parts[0])
+	}
+}
+
+// ReadSchedule reads a schedule of "<duration> <rate>" lines. Blank
+// lines and lines starting with '#' are ignored.
+func ReadSchedule(r io.Reader) (Steps, error) {
+	var steps Steps
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid schedule on line %d: '%s': expected '<duration> <rate>'", i, line)
+		}
+		hold, err := parseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule on line %d: '%s': %s", i, line, err.Error())
+		}
+		rate, err := parseRate(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule on line %d: '%s': %s", i, line, err.Error())
+		}
+		steps = append(steps, Step{Rate: rate, Hold: hold})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("schedule is empty")
+	}
+	return steps, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate '%s'", s)
+	}
+	if rate < 0 {
+		return 0, fmt.Errorf("rate '%s' must not be negative", s)
+	}
+	return rate, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration '%s' must be positive", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,134 @@
+package profile
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ProfileTestSuite struct{}
+
+var _ = Suite(&ProfileTestSuite{})
+
+func (*ProfileTestSuite) TestRamp(c *C) {
+	r := Ramp{From: 100, To: 200, Over: 10 * time.Second}
+	c.Assert(r.Rate(0), Equals, 100.0)
+	c.Assert(r.Rate(5*time.Second), Equals, 150.0)
+	c.Assert(r.Rate(10*time.Second), Equals, 200.0)
+	c.Assert(r.Rate(time.Minute), Equals, 200.0)
+	c.Assert(r.Duration(), Equals, 10*time.Second)
+}
+
+func (*ProfileTestSuite) TestSteps(c *C) {
+	s := Steps{{Rate: 100, Hold: time.Minute}, {Rate: 200, Hold: time.Minute}}
+	c.Assert(s.Rate(0), Equals, 100.0)
+	c.Assert(s.Rate(59*time.Second), Equals, 100.0)
+	c.Assert(s.Rate(time.Minute), Equals, 200.0)
+	c.Assert(s.Rate(time.Hour), Equals, 200.0)
+	c.Assert(s.Duration(), Equals, 2*time.Minute)
+}
+
+func (*ProfileTestSuite) TestSine(c *C) {
+	s := Sine{Min: 100, Max: 300, Period: time.Minute}
+	c.Assert(s.Rate(0), Equals, 100.0)
+	c.Assert(math.Abs(s.Rate(15*time.Second)-200) < 0.001, Equals, true)
+	c.Assert(s.Rate(30*time.Second), Equals, 300.0)
+	c.Assert(s.Rate(time.Minute), Equals, 100.0)
+	c.Assert(math.Abs(Target(s, 0, time.Minute)-12000) < 0.001, Equals, true)
+	c.Assert(s.Duration(), Equals, time.Duration(0))
+}
+
+func (*ProfileTestSuite) TestDiurnal(c *C) {
+	d := Diurnal{Min: 10, Max: 110, Period: 24 * time.Hour}
+	c.Assert(d.Rate(0), Equals, 35.0)
+	c.Assert(d.Rate(4*time.Hour), Equals, 10.0)
+	c.Assert(d.Rate(17*time.Hour), Equals, 110.0)
+	c.Assert(math.Abs(d.Rate(90*time.Minute)-21.5) < 0.001, Equals, true)
+	c.Assert(d.Rate(24*time.Hour), Equals, 35.0)
+	c.Assert(d.Duration(), Equals, time.Duration(0))
+}
+
+func (*ProfileTestSuite) TestSquare(c *C) {
+	s := Square{Low: 10, High: 50, Period: 10 * time.Second}
+	c.Assert(s.Rate(0), Equals, 10.0)
+	c.Assert(s.Rate(4*time.Second), Equals, 10.0)
+	c.Assert(s.Rate(5*time.Second), Equals, 50.0)
+	c.Assert(s.Rate(10*time.Second), Equals, 10.0)
+	c.Assert(s.Duration(), Equals, time.Duration(0))
+}
+
+func (*ProfileTestSuite) TestAdjustable(c *C) {
+	a := NewAdjustable(100)
+	c.Assert(a.Rate(time.Hour), Equals, 100.0)
+	a.Set(0.5)
+	c.Assert(a.Rate(0), Equals, 0.5)
+	c.Assert(a.Duration(), Equals, time.Duration(0))
+}
+
+func (*ProfileTestSuite) TestTarget(c *C) {
+	c.Assert(Target(Constant(100), 0, 10*time.Second), Equals, 1000.0)
+	c.Assert(Target(Constant(100), 10*time.Second, 0), Equals, 0.0)
+
+	r := Ramp{From: 0, To: 100, Over: 10 * time.Second}
+	c.Assert(math.Abs(Target(r, 0, 10*time.Second)-500) < 0.001, Equals, true)
+
+	s := Steps{{Rate: 100, Hold: 5 * time.Second}, {Rate: 200, Hold: 5 * time.Second}}
+	c.Assert(math.Abs(Target(s, 0, 10*time.Second)-1500) < 0.001, Equals, true)
+}
+
+func (*ProfileTestSuite) TestParse(c *C) {
+	p, err := Parse("ramp:10:0.5:1m")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Ramp{From: 10, To: 0.5, Over: time.Minute})
+
+	p, err = Parse("step:100,200,400:30s")
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, Steps{
+		{Rate: 100, Hold: 30 * time.Second},
+		{Rate: 200, Hold: 30 * time.Second},
+		{Rate: 400, Hold: 30 * time.Second},
+	})
+
+	p, err = Parse("sine:100:200:1h")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Sine{Min: 100, Max: 200, Period: time.Hour})
+
+	p, err = Parse("diurnal:0:1000:24h")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Diurnal{Min: 0, Max: 1000, Period: 24 * time.Hour})
+
+	p, err = Parse("square:5:50:2m")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, Square{Low: 5, High: 50, Period: 2 * time.Minute})
+
+	_, err = Parse("ramp:10:20")
+	c.Assert(err, ErrorMatches, "ramp should be .*")
+	_, err = Parse("step:100,abc:30s")
+	c.Assert(err, ErrorMatches, "invalid rate 'abc'")
+	_, err = Parse("step:100:0s")
+	c.Assert(err, ErrorMatches, "duration '0s' must be positive")
+	_, err = Parse("sine:100:200")
+	c.Assert(err, ErrorMatches, "sine should be sine:<min>:<max>:<period>")
+	_, err = Parse("wobble:1")
+	c.Assert(err, ErrorMatches, "unknown profile 'wobble'")
+}
+
+func (*ProfileTestSuite) TestReadSchedule(c *C) {
+	s, err := ReadSchedule(strings.NewReader("# warm up\n30s 10\n\n1m 100.5\n"))
+	c.Assert(err, IsNil)
+	c.Assert(s, DeepEquals, Steps{
+		{Rate: 10, Hold: 30 * time.Second},
+		{Rate: 100.5, Hold: time.Minute},
+	})
+
+	_, err = ReadSchedule(strings.NewReader("30s\n"))
+	c.Assert(err, ErrorMatches, "invalid schedule on line 1: '30s': .*")
+	_, err = ReadSchedule(strings.NewReader("# nothing\n"))
+	c.Assert(err, ErrorMatches, "schedule is empty")
+}
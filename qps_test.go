@@ -24,3 +24,20 @@ func checkDuration(targetQPS int, expectedWaitTimeMs float64, t *testing.T) {
 			targetQPS, expected, got)
 	}
 }
+
+func TestRateCalc(t *testing.T) {
+	// At 0.5 req/s, we expect to wait 2 seconds
+	checkRateDuration(0.5, 2*time.Second, t)
+	// At 100 req/s, we expect to wait 10 milliseconds
+	checkRateDuration(100, 10*time.Millisecond, t)
+	// At 2500.5 req/s spread over 10 threads, we expect each to wait 3.9992 milliseconds
+	checkRateDuration(2500.5/10, 3999200*time.Nanosecond, t)
+}
+
+func checkRateDuration(targetRate float64, expected time.Duration, t *testing.T) {
+	got := CalcTimeToWaitForRate(targetRate)
+	if expected != got {
+		t.Errorf("For %f req/s, expected to wait %s, instead we wait %s",
+			targetRate, expected, got)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// responseRule matches responses that meet all of its conditions.
+type responseRule struct {
+	spec string
+	// Status codes from minCode to maxCode, inclusive, match. Both are 0 if
+	// the rule doesn't check the status code.
+	minCode int
+	maxCode int
+	// headers must be present, with the given value unless it is empty,
+	// and absentHeaders must not be.
+	headers       map[string]string
+	absentHeaders []string
+	body          [][]byte
+	bodyRes       []*regexp.Regexp
+	jsonValues    []jsonValue
+}
+
+// jsonValue checks that the value at path in a JSON body is value.
+type jsonValue struct {
+	path  []string
+	value string
+}
+
+// parseResponseRule parses a comma separated list of conditions, each one
+// of status:<code>, status:<from>-<to>, header:<name>, header:<name>=<value>,
+// !header:<name>, body:<substring>, bodyRe:<regexp> or json:<path>=<value>.
+func parseResponseRule(spec string) (responseRule, error) {
+	rule := responseRule{spec: spec, headers: make(map[string]string)}
+	for _, cond := range strings.Split(spec, ",") {
+		parts := strings.SplitN(cond, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return rule, fmt.Errorf("invalid condition %q, should be kind:value", cond)
+		}
+		kind, value := parts[0], parts[1]
+		switch kind {
+		case "status":
+			from, to := value, value
+			if i := strings.Index(value, "-"); i >= 0 {
+				from, to = value[:i], value[i+1:]
+			}
+			min, err := strconv.Atoi(from)
+			if err != nil {
+				return rule, fmt.Errorf("invalid status %q", value)
+			}
+			max, err := strconv.Atoi(to)
+			if err != nil || max < min {
+				return rule, fmt.Errorf("invalid status %q", value)
+			}
+			rule.minCode, rule.maxCode = min, max
+		case "header":
+			nameValue := strings.SplitN(value, "=", 2)
+			name := http.CanonicalHeaderKey(strings.TrimSpace(nameValue[0]))
+			rule.headers[name] = ""
+			if len(nameValue) == 2 {
+				rule.headers[name] = nameValue[1]
+			}
+		case "!header":
+			rule.absentHeaders = append(rule.absentHeaders, http.CanonicalHeaderKey(strings.TrimSpace(value)))
+		case "body":
+			rule.body = append(rule.body, []byte(value))
+		case "bodyRe":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return rule, err
+			}
+			rule.bodyRes = append(rule.bodyRes, re)
+		case "json":
+			pathValue := strings.SplitN(value, "=", 2)
+			if len(pathValue) != 2 {
+				return rule, fmt.Errorf("invalid json condition %q, should be json:<path>=<value>", value)
+			}
+			rule.jsonValues = append(rule.jsonValues, jsonValue{
+				path:  parseJSONPath(pathValue[0]),
+				value: pathValue[1],
+			})
+		default:
+			return rule, fmt.Errorf("unknown condition %q, should be [status|header|!header|body|bodyRe|json]", kind)
+		}
+	}
+	return rule, nil
+}
+
+// needsBody returns true if the rule checks the response body.
+func (r *responseRule) needsBody() bool {
+	return len(r.body) > 0 || len(r.bodyRes) > 0 || len(r.jsonValues) > 0
+}
+
+func (r *responseRule) matches(response *http.Response, body []byte) bool {
+	if r.maxCode != 0 && (response.StatusCode < r.minCode || response.StatusCode > r.maxCode) {
+		return false
+	}
+	for name, value := range r.headers {
+		values, ok := response.Header[name]
+		if !ok {
+			return false
+		}
+		if value != "" && !containsString(values, value) {
+			return false
+		}
+	}
+	for _, name := range r.absentHeaders {
+		if _, ok := response.Header[name]; ok {
+			return false
+		}
+	}
+	for _, b := range r.body {
+		if !bytes.Contains(body, b) {
+			return false
+		}
+	}
+	for _, re := range r.bodyRes {
+		if !re.Match(body) {
+			return false
+		}
+	}
+	if len(r.jsonValues) > 0 {
+		doc, err := decodeJSON(body)
+		if err != nil {
+			return false
+		}
+		for _, v := range r.jsonValues {
+			if !v.matches(doc) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseJSONPath splits a path such as .items.0.name into the object keys
+// and array indexes to follow. The leading dot is optional.
+func parseJSONPath(path string) []string {
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// decodeJSON decodes body keeping numbers as they were written, so they
+// compare the same way they read.
+func decodeJSON(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc interface{}
+	err := dec.Decode(&doc)
+	return doc, err
+}
+
+// matches returns true if doc has the value at the path. Strings compare
+// without their quotes, and anything else as JSON.
+func (v *jsonValue) matches(doc interface{}) bool {
+	for _, step := range v.path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			next, ok := node[step]
+			if !ok {
+				return false
+			}
+			doc = next
+		case []interface{}:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(node) {
+				return false
+			}
+			doc = node[i]
+		default:
+			return false
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s == v.value
+	}
+	b, err := json.Marshal(doc)
+	return err == nil && string(b) == v.value
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// responseRules is a flag holding a list of rules, which can be repeated.
+type responseRules []responseRule
+
+func (r *responseRules) String() string {
+	specs := make([]string, len(*r))
+	for i, rule := range *r {
+		specs[i] = rule.spec
+	}
+	return strings.Join(specs, " ")
+}
+
+func (r *responseRules) Set(s string) error {
+	rule, err := parseResponseRule(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// matchesAny returns true if any of the rules matches.
+func (r responseRules) matchesAny(response *http.Response, body []byte) bool {
+	for i := range r {
+		if r[i].matches(response, body) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r responseRules) needBody() bool {
+	for i := range r {
+		if r[i].needsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultGoodRules count every response with a status code below 500 as
+// good.
+var defaultGoodRules = responseRules{{spec: "status:200-499", minCode: 200, maxCode: 499}}
+
+// classifier decides which responses are good. A response is bad if it
+// matches any of the bad rules, and otherwise good if it matches any of
+// the good rules.
+type classifier struct {
+	good responseRules
+	bad  responseRules
+}
+
+func newClassifier(good responseRules, bad responseRules) *classifier {
+	if len(good) == 0 {
+		good = defaultGoodRules
+	}
+	return &classifier{good: good, bad: bad}
+}
+
+// needsBody returns true if the response body is needed to classify it.
+func (c *classifier) needsBody() bool {
+	return c.good.needBody() || c.bad.needBody()
+}
+
+func (c *classifier) isGood(response *http.Response, body []byte) bool {
+	return !c.bad.matchesAny(response, body) && c.good.matchesAny(response, body)
+}
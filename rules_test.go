@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func response(code int, headers map[string]string) *http.Response {
+	r := &http.Response{StatusCode: code, Header: make(http.Header)}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestParseResponseRule(t *testing.T) {
+	rule, err := parseResponseRule("status:500-503,header:x-failover=true,body:draining,bodyRe:^[a-z]+$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.minCode != 500 || rule.maxCode != 503 {
+		t.Errorf("Expected status 500-503, instead got %d-%d", rule.minCode, rule.maxCode)
+	}
+	if rule.headers["X-Failover"] != "true" {
+		t.Errorf("Expected a canonical X-Failover header, instead got %v", rule.headers)
+	}
+	if len(rule.body) != 1 || len(rule.bodyRes) != 1 || !rule.needsBody() {
+		t.Errorf("Expected a body and a body regexp condition")
+	}
+
+	for _, spec := range []string{"", "status", "status:abc", "status:503-500", "code:200", "bodyRe:["} {
+		if _, err := parseResponseRule(spec); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestResponseRuleMatches(t *testing.T) {
+	var rules responseRules
+	rules.Set("status:503,header:X-Failover=true")
+	rules.Set("status:200,body:ok")
+
+	for _, c := range []struct {
+		response *http.Response
+		body     string
+		matches  bool
+	}{
+		{response(503, map[string]string{"X-Failover": "true"}), "", true},
+		{response(503, map[string]string{"X-Failover": "false"}), "", false},
+		{response(503, nil), "", false},
+		{response(200, nil), "all ok", true},
+		{response(200, nil), "error", false},
+		{response(404, nil), "ok", false},
+	} {
+		if got := rules.matchesAny(c.response, []byte(c.body)); got != c.matches {
+			t.Errorf("Expected a %d response with headers %v and body %q to match=%t", c.response.StatusCode, c.response.Header, c.body, c.matches)
+		}
+	}
+}
+
+func TestClassifier(t *testing.T) {
+	// By default anything below 500 is good.
+	c := newClassifier(nil, nil)
+	if !c.isGood(response(404, nil), nil) || c.isGood(response(500, nil), nil) {
+		t.Errorf("Expected the default rules to count a 404 as good and a 500 as bad")
+	}
+	if c.needsBody() {
+		t.Errorf("Expected the default rules not to need the body")
+	}
+
+	// Bad rules win over good ones.
+	var good, bad responseRules
+	good.Set("status:200-399")
+	bad.Set("body:error")
+	c = newClassifier(good, bad)
+	if c.isGood(response(404, nil), nil) {
+		t.Errorf("Expected a 404 to be bad")
+	}
+	if c.isGood(response(200, nil), []byte("an error")) {
+		t.Errorf("Expected a 200 with an error in its body to be bad")
+	}
+	if !c.isGood(response(200, nil), []byte("fine")) || !c.needsBody() {
+		t.Errorf("Expected a 200 to be good, using the body")
+	}
+}
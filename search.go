@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// searchStep is the outcome of running one interval at a fixed rate
+// during a capacity search.
+type searchStep struct {
+	rate      float64
+	p99       int64
+	errorRate float64
+	// achieved is the fraction of the requests the rate called for that
+	// were sent. A closed-loop client that can't keep up drops the rest,
+	// which keeps latency low however high the rate is.
+	achieved float64
+	passed   bool
+}
+
+// capacitySearch looks for the highest rate the target sustains while
+// staying within an SLO. The exponential strategy multiplies the rate by
+// factor after every passing step and stops at the first failure. The
+// binary strategy does the same until a step fails and then bisects
+// between the highest passing and lowest failing rates until they are
+// within precision of each other.
+type capacitySearch struct {
+	strategy  string
+	start     float64
+	factor    float64
+	precision float64
+	// maxRate caps the rates tried, 0 means no cap.
+	maxRate float64
+	// passing is the highest rate that passed, failing the lowest rate
+	// that failed. Both are 0 until such a rate has been seen.
+	passing float64
+	failing float64
+	steps   []searchStep
+}
+
+func newCapacitySearch(strategy string, start float64, maxRate float64, precision float64) *capacitySearch {
+	return &capacitySearch{
+		strategy:  strategy,
+		start:     start,
+		factor:    2,
+		precision: precision,
+		maxRate:   maxRate,
+	}
+}
+
+// record adds the outcome of a step and returns the rate to try next. It
+// returns false once the search is complete.
+func (s *capacitySearch) record(step searchStep) (float64, bool) {
+	s.steps = append(s.steps, step)
+	if step.passed {
+		if step.rate > s.passing {
+			s.passing = step.rate
+		}
+	} else if s.failing == 0 || step.rate < s.failing {
+		s.failing = step.rate
+	}
+
+	if s.failing == 0 {
+		if s.maxRate > 0 && step.rate >= s.maxRate {
+			return 0, false
+		}
+		next := step.rate * s.factor
+		if s.maxRate > 0 && next > s.maxRate {
+			next = s.maxRate
+		}
+		return next, true
+	}
+
+	if s.strategy == "exponential" {
+		return 0, false
+	}
+	if s.passing == 0 {
+		// Nothing has passed yet, so keep halving until something does or
+		// we're well below where we started.
+		next := s.failing / 2
+		if next < s.start*s.precision {
+			return 0, false
+		}
+		return next, true
+	}
+	if s.failing-s.passing <= s.precision*s.passing {
+		return 0, false
+	}
+	return (s.passing + s.failing) / 2, true
+}
+
+// capacity returns the highest rate found to be sustainable.
+func (s *capacitySearch) capacity() float64 {
+	return s.passing
+}
+
+// printResults writes a table of every step followed by the capacity.
+func (s *capacitySearch) printResults(w io.Writer, latencyUnit string) {
+	fmt.Fprintf(w, "# step       rate  p99(%s) errors    sent result\n", latencyUnit)
+	for i, step := range s.steps {
+		result := "fail"
+		if step.passed {
+			result = "pass"
+		}
+		fmt.Fprintf(w, "%6d %10s %8d %5.2f%% %6.2f%% %s\n",
+			i,
+			formatRate(step.rate),
+			step.p99,
+			step.errorRate*100,
+			step.achieved*100,
+			result)
+	}
+	fmt.Fprintf(w, "# capacity: %s req/s\n", formatRate(s.capacity()))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// runSearch runs a search against a target that can sustain up to
+// capacity req/s and returns the rate the search settled on.
+func runSearch(s *capacitySearch, capacity float64) float64 {
+	rate := s.start
+	for more := true; more; {
+		rate, more = s.record(searchStep{rate: rate, passed: rate <= capacity})
+	}
+	return s.capacity()
+}
+
+func TestExponentialSearch(t *testing.T) {
+	s := newCapacitySearch("exponential", 100, 0, 0.05)
+	if got := runSearch(s, 1000); got != 800 {
+		t.Errorf("Expected a capacity of 800, instead got %f", got)
+	}
+	if len(s.steps) != 5 {
+		t.Errorf("Expected 5 steps, instead got %d", len(s.steps))
+	}
+}
+
+func TestBinarySearch(t *testing.T) {
+	s := newCapacitySearch("binary", 100, 0, 0.05)
+	if got := runSearch(s, 1000); got > 1000 || got < 950 {
+		t.Errorf("Expected a capacity within 5%% of 1000, instead got %f", got)
+	}
+
+	// Starting above capacity searches downwards.
+	s = newCapacitySearch("binary", 1000, 0, 0.05)
+	if got := runSearch(s, 300); got > 300 || got < 285 {
+		t.Errorf("Expected a capacity within 5%% of 300, instead got %f", got)
+	}
+
+	// Nothing passing still ends the search.
+	s = newCapacitySearch("binary", 1000, 0, 0.05)
+	if got := runSearch(s, 0); got != 0 {
+		t.Errorf("Expected a capacity of 0, instead got %f", got)
+	}
+}
+
+func TestSearchMaxRate(t *testing.T) {
+	s := newCapacitySearch("binary", 100, 500, 0.05)
+	if got := runSearch(s, 1000); got != 500 {
+		t.Errorf("Expected a capacity of 500, instead got %f", got)
+	}
+}
+
+func TestSearchResults(t *testing.T) {
+	s := newCapacitySearch("exponential", 100, 0, 0.05)
+	s.record(searchStep{rate: 100, p99: 12, achieved: 1, passed: true})
+	s.record(searchStep{rate: 200, p99: 250, errorRate: 0.125, achieved: 0.8, passed: false})
+
+	var out bytes.Buffer
+	s.printResults(&out, "ms")
+	expected := "# step       rate  p99(ms) errors    sent result\n" +
+		"     0        100       12  0.00% 100.00% pass\n" +
+		"     1        200      250 12.50%  80.00% fail\n" +
+		"# capacity: 100 req/s\n"
+	if out.String() != expected {
+		t.Errorf("Expected results:\n%s\ninstead got:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// requestSource holds the parts of each request that can be given as an
+// @path and reloaded from it with SIGHUP.
+type requestSource struct {
+	urls    []*url.URL
+	headers headerSet
+	data    []byte
+}
+
+// headerFlags collects -header flags. Each is either a single header or an
+// @path to a file with one header per line.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return ""
+}
+
+func (h *headerFlags) Set(s string) error {
+	if !strings.HasPrefix(s, "@") {
+		parsed := make(headerSet)
+		if err := parsed.Set(s); err != nil {
+			return err
+		}
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// load builds the set of headers, reading any header files. Later headers
+// replace earlier ones with the same name.
+func (h headerFlags) load() (headerSet, error) {
+	headers := make(headerSet)
+	for _, value := range h {
+		if !strings.HasPrefix(value, "@") {
+			headers.Set(value)
+			continue
+		}
+		file, err := openSource(value[1:])
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for i := 1; scanner.Scan(); i++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if err := headers.Set(line); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("invalid header on line %d of %s: '%s'", i, value[1:], line)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return headers, nil
+}
+
+// reloadable returns whether any headers come from files, none of which
+// are stdin.
+func (h headerFlags) reloadable() bool {
+	files := 0
+	for _, value := range h {
+		if value == "@-" {
+			return false
+		}
+		if strings.HasPrefix(value, "@") {
+			files++
+		}
+	}
+	return files > 0
+}
+
+// openSource opens the file at path, or stdin if path is "-".
+func openSource(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// reloadable returns whether a flag value is read from a file that can be
+// read again.
+func reloadable(value string) bool {
+	return strings.HasPrefix(value, "@") && value != "@-"
+}
+
+func readData(data string) ([]byte, error) {
+	if !strings.HasPrefix(data, "@") {
+		return []byte(data), nil
+	}
+	file, err := openSource(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func readURLs(urldest string) ([]*url.URL, error) {
+	var urls []*url.URL
+	var scanner *bufio.Scanner
+
+	if strings.HasPrefix(urldest, "@") {
+		file, err := openSource(urldest[1:])
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner = bufio.NewScanner(file)
+	} else {
+		scanner = bufio.NewScanner(strings.NewReader(urldest))
+	}
+
+	for i := 1; scanner.Scan(); i++ {
+		line := scanner.Text()
+		URL, err := url.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL on line %d: '%s': %s", i, line, err.Error())
+		} else if URL.Scheme == "" {
+			return nil, fmt.Errorf("invalid URL on line %d: '%s': Missing scheme", i, line)
+		} else if URL.Host == "" {
+			return nil, fmt.Errorf("invalid URL on line %d: '%s': Missing host", i, line)
+		}
+		urls = append(urls, URL)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no URLs found in '%s'", urldest)
+	}
+
+	return urls, nil
+}
+
+// reloadRequestSource rereads whichever of the url list, headers and data
+// were given as files, keeping the rest of the current source.
+func reloadRequestSource(current *requestSource, urldest string, headers headerFlags, data string) (*requestSource, error) {
+	next := *current
+	if reloadable(urldest) {
+		urls, err := readURLs(urldest)
+		if err != nil {
+			return nil, err
+		}
+		next.urls = urls
+	}
+	if headers.reloadable() {
+		loaded, err := headers.load()
+		if err != nil {
+			return nil, err
+		}
+		next.headers = loaded
+	}
+	if reloadable(data) {
+		loaded, err := readData(data)
+		if err != nil {
+			return nil, err
+		}
+		next.data = loaded
+	}
+	return &next, nil
+}
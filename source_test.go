@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadURLs(t *testing.T) {
+	urls, err := readURLs("http://localhost:4140/")
+	if err != nil || len(urls) != 1 || urls[0].Host != "localhost:4140" {
+		t.Errorf("Expected a single url, instead got %v, %v", urls, err)
+	}
+	if _, err := readURLs("localhost:4140"); err == nil {
+		t.Errorf("Expected an error for a url without a scheme")
+	}
+}
+
+func TestHeaderFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slow_cooker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers")
+	ioutil.WriteFile(path, []byte("X-A: 1\n\nX-B: 2\n"), 0644)
+
+	var h headerFlags
+	if err := h.Set("X-B: 3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Set("@" + path); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Set("invalid"); err == nil {
+		t.Errorf("Expected an error for an invalid header")
+	}
+	headers, err := h.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Headers from the file replace those given before it.
+	if len(headers) != 2 || headers["X-A"] != "1" || headers["X-B"] != "2" {
+		t.Errorf("Expected headers from the file, instead got %v", headers)
+	}
+}
+
+func TestReloadRequestSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slow_cooker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	urlPath := filepath.Join(dir, "urls")
+	dataPath := filepath.Join(dir, "data")
+	ioutil.WriteFile(urlPath, []byte("http://localhost:4140/a\n"), 0644)
+	ioutil.WriteFile(dataPath, []byte("before"), 0644)
+
+	headers := headerFlags{"X-A: 1"}
+	current := &requestSource{
+		urls:    loadURLs("@" + urlPath),
+		headers: headerSet{"X-A": "1"},
+		data:    loadData("@" + dataPath),
+	}
+
+	ioutil.WriteFile(urlPath, []byte("http://localhost:4140/a\nhttp://localhost:4140/b\n"), 0644)
+	ioutil.WriteFile(dataPath, []byte("after"), 0644)
+	next, err := reloadRequestSource(current, "@"+urlPath, headers, "@"+dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.urls) != 2 || string(next.data) != "after" || next.headers["X-A"] != "1" {
+		t.Errorf("Expected the url list and data to be reloaded, instead got %v, %v, %s", next.urls, next.headers, next.data)
+	}
+
+	// A broken file leaves the current source alone.
+	ioutil.WriteFile(urlPath, []byte("nonsense\n"), 0644)
+	if _, err := reloadRequestSource(next, "@"+urlPath, headers, "@"+dataPath); err == nil {
+		t.Errorf("Expected an error reloading an invalid url list")
+	}
+	if len(next.urls) != 2 {
+		t.Errorf("Expected the current source to be unchanged, instead got %v", next.urls)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// intervalStats accumulates the results of requests over one interval.
+type intervalStats struct {
+	count    uint64
+	size     uint64
+	good     uint64
+	bad      uint64
+	failed   uint64
+	timeouts uint64
+	// codes counts responses by status code and errors failed requests by
+	// class of error.
+	codes          map[int]uint64
+	errors         map[string]uint64
+	min            int64
+	max            int64
+	burstResponses uint64
+	// checkFailures counts the responses that failed each response check.
+	checkFailures [maxChecks]uint64
+	// newConns and reusedConns count the responses received on new and
+	// reused connections, and idleHist how long reused connections had
+	// been idle.
+	newConns       uint64
+	reusedConns    uint64
+	tlsResumptions uint64
+	idleHist       *hdrhistogram.Histogram
+	// sent counts requests dispatched by the request threads, skipped the
+	// sends they dropped for falling behind schedule, and maxLag is the
+	// furthest behind schedule any dispatch was. Bursts are left out.
+	sent    uint64
+	skipped uint64
+	maxLag  int64
+	// phase is set if any samples were taken outside of steady state.
+	phase string
+	hist  *hdrhistogram.Histogram
+	// steadyHist holds only the samples taken in steady state, which are
+	// the ones that count toward the final summary.
+	steadyHist *hdrhistogram.Histogram
+	// queueHist is only kept in pool mode, and the burst histograms only
+	// when sending bursts.
+	queueHist       *hdrhistogram.Histogram
+	burstHist       *hdrhistogram.Histogram
+	steadyBurstHist *hdrhistogram.Histogram
+	// altHist is only kept when a second latency measure is reported
+	// alongside the main one.
+	altHist *hdrhistogram.Histogram
+	// stageHists hold the steady state latency of each stage of requests.
+	stageHists [numStages]*hdrhistogram.Histogram
+	// groups holds the results of each group of urls, when they are broken
+	// down by url.
+	groups   map[*urlGroup]*groupStats
+	maxValue int64
+}
+
+func newIntervalStats(maxValue int64, withQueue bool, withBursts bool, withAlt bool) *intervalStats {
+	s := &intervalStats{
+		codes:      make(map[int]uint64),
+		errors:     make(map[string]uint64),
+		groups:     make(map[*urlGroup]*groupStats),
+		maxValue:   maxValue,
+		min:        math.MaxInt64,
+		hist:       hdrhistogram.New(0, maxValue, 3),
+		steadyHist: hdrhistogram.New(0, maxValue, 3),
+		idleHist:   hdrhistogram.New(0, maxValue, 3),
+	}
+	for stage := range s.stageHists {
+		s.stageHists[stage] = hdrhistogram.New(0, maxValue, 3)
+	}
+	if withQueue {
+		s.queueHist = hdrhistogram.New(0, maxValue, 3)
+	}
+	if withBursts {
+		s.burstHist = hdrhistogram.New(0, maxValue, 3)
+		s.steadyBurstHist = hdrhistogram.New(0, maxValue, 3)
+	}
+	if withAlt {
+		s.altHist = hdrhistogram.New(0, maxValue, 3)
+	}
+	return s
+}
+
+// merge adds everything recorded in other to s.
+func (s *intervalStats) merge(other *intervalStats) {
+	s.count += other.count
+	s.size += other.size
+	s.good += other.good
+	s.bad += other.bad
+	s.failed += other.failed
+	s.timeouts += other.timeouts
+	for code, n := range other.codes {
+		s.codes[code] += n
+	}
+	addCounts(s.errors, other.errors)
+	if other.min < s.min {
+		s.min = other.min
+	}
+	if other.max > s.max {
+		s.max = other.max
+	}
+	for i, n := range other.checkFailures {
+		s.checkFailures[i] += n
+	}
+	s.burstResponses += other.burstResponses
+	s.newConns += other.newConns
+	s.reusedConns += other.reusedConns
+	s.tlsResumptions += other.tlsResumptions
+	s.idleHist.Merge(other.idleHist)
+	s.sent += other.sent
+	s.skipped += other.skipped
+	if other.maxLag > s.maxLag {
+		s.maxLag = other.maxLag
+	}
+	if other.phase != "" {
+		s.phase = other.phase
+	}
+	s.hist.Merge(other.hist)
+	s.steadyHist.Merge(other.steadyHist)
+	for stage, h := range s.stageHists {
+		h.Merge(other.stageHists[stage])
+	}
+	if s.queueHist != nil {
+		s.queueHist.Merge(other.queueHist)
+	}
+	if s.burstHist != nil {
+		s.burstHist.Merge(other.burstHist)
+		s.steadyBurstHist.Merge(other.steadyBurstHist)
+	}
+	if s.altHist != nil {
+		s.altHist.Merge(other.altHist)
+	}
+	for g, gs := range other.groups {
+		s.group(g).merge(gs)
+	}
+}
+
+// group returns the stats of a group of urls.
+func (s *intervalStats) group(g *urlGroup) *groupStats {
+	gs, ok := s.groups[g]
+	if !ok {
+		gs = newGroupStats(s.maxValue)
+		s.groups[g] = gs
+	}
+	return gs
+}
+
+// reset clears s for the next interval.
+func (s *intervalStats) reset() {
+	s.count = 0
+	s.size = 0
+	s.good = 0
+	s.bad = 0
+	s.failed = 0
+	s.timeouts = 0
+	for code := range s.codes {
+		delete(s.codes, code)
+	}
+	for class := range s.errors {
+		delete(s.errors, class)
+	}
+	s.min = math.MaxInt64
+	s.max = 0
+	s.checkFailures = [maxChecks]uint64{}
+	s.burstResponses = 0
+	s.newConns = 0
+	s.reusedConns = 0
+	s.tlsResumptions = 0
+	s.idleHist.Reset()
+	s.sent = 0
+	s.skipped = 0
+	s.maxLag = 0
+	s.phase = ""
+	s.hist.Reset()
+	s.steadyHist.Reset()
+	for _, h := range s.stageHists {
+		h.Reset()
+	}
+	if s.queueHist != nil {
+		s.queueHist.Reset()
+	}
+	if s.burstHist != nil {
+		s.burstHist.Reset()
+		s.steadyBurstHist.Reset()
+	}
+	if s.altHist != nil {
+		s.altHist.Reset()
+	}
+	for _, gs := range s.groups {
+		gs.reset()
+	}
+}
+
+// statusCodeCounters caches the status_codes counter of each status code
+// from 100 to 599, so responses don't build a label to find theirs. They
+// are made when first needed, so only the codes seen are exported.
+var statusCodeCounters [500]atomic.Value
+
+func statusCodeCounter(code int) prometheus.Counter {
+	if code < 100 || code > 599 {
+		return promStatusCodes.WithLabelValues(strconv.Itoa(code))
+	}
+	cached := &statusCodeCounters[code-100]
+	if c, ok := cached.Load().(prometheus.Counter); ok {
+		return c
+	}
+	// Racing stores store the same counter.
+	c := promStatusCodes.WithLabelValues(strconv.Itoa(code))
+	cached.Store(c)
+	return c
+}
+
+// statsShard is the intervalStats a subset of requests record into.
+type statsShard struct {
+	sync.Mutex
+	stats *intervalStats
+}
+
+// recorder collects the results of requests as they complete. Results are
+// spread over several shards so that request threads rarely contend, and
+// are only merged together at the end of each interval.
+type recorder struct {
+	shards     []statsShard
+	latencyDur time.Duration
+
+	// printed holds the classes of error printed this interval. Only the
+	// first error of each class is printed, the rest are just counted.
+	printedLock sync.Mutex
+	printed     map[string]bool
+}
+
+// newRecorder returns a recorder with the given number of shards, each
+// made by newStats.
+func newRecorder(shards int, newStats func() *intervalStats, latencyDur time.Duration) *recorder {
+	r := &recorder{
+		shards:     make([]statsShard, shards),
+		latencyDur: latencyDur,
+		printed:    make(map[string]bool),
+	}
+	for i := range r.shards {
+		r.shards[i].stats = newStats()
+	}
+	return r
+}
+
+// record adds a response to the shard picked by key.
+func (r *recorder) record(key uint64, resp *MeasuredResponse) {
+	metrics := allURLMetrics
+	if resp.group != nil {
+		metrics = resp.group.metrics
+	}
+	metrics.requests.Inc()
+	promResponseBytes.Add(float64(resp.sz))
+	// Samples of requests sent during warmup or cooldown only count
+	// toward the interval they were taken in.
+	phase := resp.phase
+	steady := phase == ""
+
+	respLatencyNS := resp.latency.Nanoseconds()
+	latency := respLatencyNS / r.latencyDur.Nanoseconds()
+	success := resp.err == nil && resp.good
+	errClass := resp.errClass
+	if resp.err != nil {
+		if errClass == "" {
+			errClass = errorClass(resp.err)
+		}
+		if r.firstOfInterval(errClass) {
+			fmt.Fprintln(os.Stderr, resp.err)
+		}
+		if resp.timeout {
+			promTimeouts.Inc()
+		}
+		promErrors.WithLabelValues(errClass).Inc()
+	} else {
+		statusCodeCounter(resp.code).Inc()
+	}
+	if resp.err == nil && steady {
+		for stage, took := range resp.stages.took {
+			if took {
+				promStageHistograms[stage].Observe(float64(resp.stages.durations[stage] / time.Microsecond))
+			}
+		}
+	}
+	if resp.conn.reused {
+		promConnsReused.Inc()
+		promConnIdleHistogram.Observe(float64(resp.conn.idle / time.Microsecond))
+	}
+	if resp.conn.resumed {
+		promTLSResumptions.Inc()
+	}
+	if success {
+		metrics.successes.Inc()
+		// Burst latencies would skew the baseline ones, as they do in the
+		// summary.
+		if steady && !resp.burst {
+			metrics.recordLatency(resp.latency)
+		}
+	}
+
+	shard := &r.shards[key%uint64(len(r.shards))]
+	shard.Lock()
+	defer shard.Unlock()
+	s := shard.stats
+
+	s.count++
+	if phase != "" {
+		s.phase = phase
+	}
+	if s.queueHist != nil && !resp.burst {
+		s.queueHist.RecordValue(resp.queueWait.Nanoseconds() / r.latencyDur.Nanoseconds())
+	}
+	if resp.group != nil && !resp.burst {
+		s.group(resp.group).record(success, resp.err != nil, latency, steady)
+	}
+	if resp.err != nil {
+		s.failed++
+		if resp.timeout {
+			s.timeouts++
+		}
+		s.errors[errClass]++
+		return
+	}
+
+	s.size += resp.sz
+	s.codes[resp.code]++
+	if resp.conn.got {
+		if resp.conn.reused {
+			s.reusedConns++
+			s.idleHist.RecordValue(resp.conn.idle.Nanoseconds() / r.latencyDur.Nanoseconds())
+		} else {
+			s.newConns++
+		}
+		if resp.conn.resumed {
+			s.tlsResumptions++
+		}
+	}
+	if steady {
+		for stage, took := range resp.stages.took {
+			if took {
+				s.stageHists[stage].RecordValue(resp.stages.durations[stage].Nanoseconds() / r.latencyDur.Nanoseconds())
+			}
+		}
+	}
+	for failed, i := resp.failedChecks, 0; failed != 0; failed, i = failed>>1, i+1 {
+		if failed&1 != 0 {
+			s.checkFailures[i]++
+		}
+	}
+	if success {
+		s.good++
+	} else {
+		s.bad++
+	}
+
+	if resp.burst {
+		s.burstResponses++
+		s.burstHist.RecordValue(latency)
+		if steady {
+			s.steadyBurstHist.RecordValue(latency)
+		}
+		return
+	}
+
+	if latency < s.min {
+		s.min = latency
+	}
+	if latency > s.max {
+		s.max = latency
+	}
+	s.hist.RecordValue(latency)
+	if s.altHist != nil {
+		s.altHist.RecordValue(resp.altLatency.Nanoseconds() / r.latencyDur.Nanoseconds())
+	}
+	if steady {
+		s.steadyHist.RecordValue(latency)
+	}
+}
+
+// firstOfInterval returns true if no error of class has been seen yet this
+// interval.
+func (r *recorder) firstOfInterval(class string) bool {
+	r.printedLock.Lock()
+	defer r.printedLock.Unlock()
+	if r.printed[class] {
+		return false
+	}
+	r.printed[class] = true
+	return true
+}
+
+// dispatched records that a request was sent lag behind schedule, after
+// skipped sends were dropped, into the shard picked by key.
+func (r *recorder) dispatched(key uint64, lag time.Duration, skipped uint64) {
+	promSent.Inc()
+	promSkipped.Add(float64(skipped))
+	lagUnits := lag.Nanoseconds() / r.latencyDur.Nanoseconds()
+	shard := &r.shards[key%uint64(len(r.shards))]
+	shard.Lock()
+	defer shard.Unlock()
+	s := shard.stats
+	s.sent++
+	s.skipped += skipped
+	if lagUnits > s.maxLag {
+		s.maxLag = lagUnits
+	}
+}
+
+// collect merges the results recorded in every shard into into, and resets
+// the shards and the errors printed for the next interval.
+func (r *recorder) collect(into *intervalStats) {
+	r.printedLock.Lock()
+	for class := range r.printed {
+		delete(r.printed, class)
+	}
+	r.printedLock.Unlock()
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.Lock()
+		into.merge(shard.stats)
+		shard.stats.reset()
+		shard.Unlock()
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRecorderMergesShards(t *testing.T) {
+	rec := newRecorder(4, func() *intervalStats {
+		return newIntervalStats(int64(time.Hour/time.Millisecond), false, true, false)
+	}, time.Millisecond)
+	for i := uint64(0); i < 10; i++ {
+		rec.record(i, &MeasuredResponse{sz: 10, code: 200, good: true, latency: time.Duration(i+1) * time.Millisecond})
+	}
+	rec.record(1, &MeasuredResponse{code: 503, latency: 20 * time.Millisecond})
+	rec.record(2, &MeasuredResponse{err: errors.New("connection refused")})
+	rec.record(4, &MeasuredResponse{err: errors.New("timeout"), errClass: errTimeout, timeout: true})
+	rec.record(3, &MeasuredResponse{code: 200, good: true, latency: 50 * time.Millisecond, burst: true})
+	rec.dispatched(1, 2*time.Millisecond, 0)
+	rec.dispatched(2, 7*time.Millisecond, 3)
+
+	stats := newIntervalStats(int64(time.Hour/time.Millisecond), false, true, false)
+	rec.collect(stats)
+	if stats.count != 14 || stats.good != 11 || stats.bad != 1 || stats.failed != 2 {
+		t.Errorf("Expected 14 responses, 11 good, 1 bad and 2 failed, instead got %d, %d, %d and %d",
+			stats.count, stats.good, stats.bad, stats.failed)
+	}
+	if stats.timeouts != 1 {
+		t.Errorf("Expected 1 timeout, instead got %d", stats.timeouts)
+	}
+	if codes := formatCodes(stats.codes); codes != "200:11,503:1" {
+		t.Errorf("Expected status codes 200:11,503:1, instead got %s", codes)
+	}
+	if errors := formatCounts(stats.errors); errors != "other:1,timeout:1" {
+		t.Errorf("Expected errors other:1,timeout:1, instead got %s", errors)
+	}
+	if stats.size != 100 {
+		t.Errorf("Expected 100 bytes, instead got %d", stats.size)
+	}
+	if stats.min != 1 || stats.max != 20 {
+		t.Errorf("Expected latencies from 1ms to 20ms, instead got %dms to %dms", stats.min, stats.max)
+	}
+	if stats.sent != 2 || stats.skipped != 3 || stats.maxLag != 7 {
+		t.Errorf("Expected 2 sent, 3 skipped and a max lag of 7ms, instead got %d, %d and %dms",
+			stats.sent, stats.skipped, stats.maxLag)
+	}
+	if stats.hist.TotalCount() != 11 || stats.burstHist.TotalCount() != 1 {
+		t.Errorf("Expected 11 samples and 1 burst sample, instead got %d and %d",
+			stats.hist.TotalCount(), stats.burstHist.TotalCount())
+	}
+
+	// Collecting resets the shards for the next interval.
+	stats.reset()
+	rec.collect(stats)
+	if stats.count != 0 || stats.hist.TotalCount() != 0 {
+		t.Errorf("Expected an empty interval, instead got %d responses", stats.count)
+	}
+}
+
+func TestPhaseIsTheOneRequestsWereSentIn(t *testing.T) {
+	// A request sent during warmup is left out of steady state, however
+	// late its response is recorded.
+	rec := newRecorder(1, newBenchmarkStats, time.Microsecond)
+	rec.record(0, &MeasuredResponse{code: 200, good: true, latency: time.Millisecond, phase: "warmup"})
+	rec.record(0, &MeasuredResponse{code: 200, good: true, latency: time.Millisecond})
+	stats := newBenchmarkStats()
+	rec.collect(stats)
+	if stats.phase != "warmup" || stats.hist.TotalCount() != 2 || stats.steadyHist.TotalCount() != 1 {
+		t.Errorf("Expected 2 samples, 1 of them in steady state, in an interval marked warmup, instead got %d and %d in %q",
+			stats.hist.TotalCount(), stats.steadyHist.TotalCount(), stats.phase)
+	}
+}
+
+func TestErrorsArePrintedOncePerInterval(t *testing.T) {
+	rec := newRecorder(1, newBenchmarkStats, time.Millisecond)
+	if !rec.firstOfInterval(errRefused) || rec.firstOfInterval(errRefused) {
+		t.Errorf("Expected only the first refused error to be printed")
+	}
+	if !rec.firstOfInterval(errTimeout) {
+		t.Errorf("Expected the first timeout to be printed")
+	}
+	rec.collect(newBenchmarkStats())
+	if !rec.firstOfInterval(errRefused) {
+		t.Errorf("Expected the first refused error of the next interval to be printed")
+	}
+}
+
+func TestStatusCodeCountersAreCached(t *testing.T) {
+	for _, code := range []int{100, 404, 599, 999} {
+		expected := promStatusCodes.WithLabelValues(strconv.Itoa(code))
+		if c := statusCodeCounter(code); c != expected || statusCodeCounter(code) != expected {
+			t.Errorf("Expected the status_codes counter of %d", code)
+		}
+	}
+}
+
+func TestBurstsAreLeftOutOfPrometheusLatency(t *testing.T) {
+	newStats := func() *intervalStats { return newIntervalStats(1000, false, true, false) }
+	rec := newRecorder(1, newStats, time.Millisecond)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(promLatencyMSHistogram)
+	observed := func() uint64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count uint64
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				count += m.GetHistogram().GetSampleCount()
+			}
+		}
+		return count
+	}
+	before := observed()
+	rec.record(0, &MeasuredResponse{code: 200, good: true, latency: time.Millisecond, burst: true})
+	if got := observed(); got != before {
+		t.Errorf("Expected a burst response not to be observed, instead got %d new samples", got-before)
+	}
+	rec.record(0, &MeasuredResponse{code: 200, good: true, latency: time.Millisecond})
+	if got := observed(); got != before+1 {
+		t.Errorf("Expected a baseline response to be observed, instead got %d new samples", got-before)
+	}
+}
+
+func BenchmarkRecord(b *testing.B) {
+	rec := newRecorder(8, newBenchmarkStats, time.Microsecond)
+	resp := MeasuredResponse{sz: 100, code: 200, good: true, latency: 3 * time.Millisecond}
+	key := uint64(0)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		k := atomic.AddUint64(&key, 1)
+		for pb.Next() {
+			rec.record(k, &resp)
+		}
+	})
+}
+
+// BenchmarkDispatch sends requests to a local server from many threads
+// and records their results, reporting the rate sustained.
+func BenchmarkDispatch(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	client := newClient(false, false, 64, time.Second, connLimits{}, false)
+	rec := newRecorder(8, newBenchmarkStats, time.Microsecond)
+	id := uint64(0)
+
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		bodyBuffer := make([]byte, 50000)
+		for pb.Next() {
+			reqID := atomic.AddUint64(&id, 1)
+			resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, reqID, time.Time{}, false, nil, bodyBuffer)
+			rec.record(reqID, &resp)
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "req/s")
+}
+
+func newBenchmarkStats() *intervalStats {
+	return newIntervalStats(int64(24*time.Hour/time.Microsecond), false, false, false)
+}
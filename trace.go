@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// The stages of a request that are timed separately.
+const (
+	stageDNS = iota
+	stageConnect
+	stageTLS
+	// stageTTFB runs from when the request was written to the first byte of
+	// the response, so mostly covers time spent in the server.
+	stageTTFB
+	stageDownload
+	numStages
+)
+
+var stageNames = [numStages]string{"dns", "connect", "tls", "ttfb", "download"}
+
+// stageTimes holds how long each stage of a request took. Stages that
+// didn't happen, such as connecting when a connection was reused, are
+// left out.
+type stageTimes struct {
+	took      [numStages]bool
+	durations [numStages]time.Duration
+}
+
+func (t *stageTimes) set(stage int, d time.Duration) {
+	t.took[stage] = true
+	t.durations[stage] = d
+}
+
+// connUse describes the connection a request was sent on.
+type connUse struct {
+	// got is false if the request never got a connection.
+	got    bool
+	reused bool
+	// idle is how long a reused connection sat idle before this request.
+	idle time.Duration
+	// resumed is set if a new TLS connection resumed an earlier session.
+	resumed bool
+}
+
+// stageTracer times the stages of a request from the httptrace events it
+// goes through. Dialing may carry on after a request has failed, so it is
+// locked.
+type stageTracer struct {
+	sync.Mutex
+	times        stageTimes
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	conn         connUse
+	// counted is the connection the request got, if slow_cooker dialed it.
+	counted *countedConn
+}
+
+func (t *stageTracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.Lock()
+			t.dnsStart = time.Now()
+			t.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.Lock()
+			t.times.set(stageDNS, time.Since(t.dnsStart))
+			t.Unlock()
+		},
+		// With several addresses to try, connecting takes from the first
+		// attempt to the one that succeeded.
+		ConnectStart: func(network, addr string) {
+			t.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				return
+			}
+			t.Lock()
+			t.times.set(stageConnect, time.Since(t.connectStart))
+			t.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.Lock()
+			t.tlsStart = time.Now()
+			t.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.Lock()
+			t.times.set(stageTLS, time.Since(t.tlsStart))
+			t.conn.resumed = err == nil && state.DidResume
+			t.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.Lock()
+			t.gotConn = time.Now()
+			t.conn.got = true
+			t.conn.reused = info.Reused
+			if info.WasIdle {
+				t.conn.idle = info.IdleTime
+			}
+			t.counted = countedConnOf(info.Conn)
+			t.Unlock()
+			if t.counted != nil {
+				t.counted.acquire()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.Lock()
+			t.wroteRequest = time.Now()
+			t.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.Lock()
+			t.firstByte = time.Now()
+			t.times.set(stageTTFB, t.firstByte.Sub(t.wroteRequest))
+			t.Unlock()
+		},
+	}
+}
+
+// firstByteAt returns when the first byte of the response arrived.
+func (t *stageTracer) firstByteAt() time.Time {
+	t.Lock()
+	defer t.Unlock()
+	return t.firstByte
+}
+
+// gotConnAt returns when the request got a connection to be sent on.
+func (t *stageTracer) gotConnAt() time.Time {
+	t.Lock()
+	defer t.Unlock()
+	return t.gotConn
+}
+
+// connection returns the connection the request was sent on.
+func (t *stageTracer) connection() connUse {
+	t.Lock()
+	defer t.Unlock()
+	return t.conn
+}
+
+// releaseConn lets go of the connection the request got, once it's done
+// with it.
+func (t *stageTracer) releaseConn() {
+	t.Lock()
+	c := t.counted
+	t.counted = nil
+	t.Unlock()
+	if c != nil {
+		c.release()
+	}
+}
+
+// finish returns the stage times of a request whose response body was
+// read by end.
+func (t *stageTracer) finish(end time.Time) stageTimes {
+	t.Lock()
+	defer t.Unlock()
+	t.times.set(stageDownload, end.Sub(t.firstByte))
+	return t.times
+}
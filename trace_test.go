@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRequestStagesAreTimed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	client := newClient(false, false, 1, time.Second, connLimits{}, false)
+
+	// The first request has to connect, the second reuses the connection.
+	resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 1, time.Time{}, false, nil, make([]byte, 512))
+	if resp.err != nil {
+		t.Fatal(resp.err)
+	}
+	if !resp.stages.took[stageConnect] {
+		t.Errorf("Expected the first request to connect")
+	}
+	if ttfb := resp.stages.durations[stageTTFB]; !resp.stages.took[stageTTFB] || ttfb < 20*time.Millisecond {
+		t.Errorf("Expected a ttfb of at least 20ms, instead got %s", ttfb)
+	}
+	if !resp.stages.took[stageDownload] {
+		t.Errorf("Expected the body download to be timed")
+	}
+
+	resp = sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 2, time.Time{}, false, nil, make([]byte, 512))
+	if resp.err != nil {
+		t.Fatal(resp.err)
+	}
+	if resp.stages.took[stageConnect] || resp.stages.took[stageDNS] {
+		t.Errorf("Expected the second request to reuse the connection")
+	}
+}
+
+func TestTLSHandshakeIsTimed(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dstURL, _ := url.Parse(server.URL)
+	client := newClient(false, false, 1, time.Second, connLimits{}, false)
+
+	resp := sendRequest(client, "GET", dstURL, "", headerSet{}, nil, 1, time.Time{}, false, nil, make([]byte, 512))
+	if resp.err != nil {
+		t.Fatal(resp.err)
+	}
+	if !resp.stages.took[stageTLS] || resp.stages.durations[stageTLS] <= 0 {
+		t.Errorf("Expected the TLS handshake to be timed")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// urlMetrics are the Prometheus metrics of one group of urls. Without a
+// per-url breakdown every request is in the group with an empty url label,
+// which Prometheus leaves out.
+type urlMetrics struct {
+	requests  prometheus.Counter
+	successes prometheus.Counter
+	latencyMS prometheus.Observer
+	latencyUS prometheus.Observer
+	latencyNS prometheus.Observer
+}
+
+func newURLMetrics(key string) urlMetrics {
+	return urlMetrics{
+		requests:  promRequests.WithLabelValues(key),
+		successes: promSuccesses.WithLabelValues(key),
+		latencyMS: promLatencyMSHistogram.WithLabelValues(key),
+		latencyUS: promLatencyUSHistogram.WithLabelValues(key),
+		latencyNS: promLatencyNSHistogram.WithLabelValues(key),
+	}
+}
+
+var allURLMetrics = newURLMetrics("")
+
+// recordLatency observes the latency of a successful request in the
+// Prometheus histograms of its group.
+func (m urlMetrics) recordLatency(latency time.Duration) {
+	m.latencyMS.Observe(float64(latency / time.Millisecond))
+	m.latencyUS.Observe(float64(latency / time.Microsecond))
+	m.latencyNS.Observe(float64(latency))
+}
+
+// urlGroup is a group of urls whose results are reported together.
+type urlGroup struct {
+	key     string
+	metrics urlMetrics
+}
+
+// groupStats accumulates the results of the requests to one group of urls
+// over an interval. Like intervalStats, it's kept by each shard and merged
+// at the end of the interval.
+type groupStats struct {
+	good       uint64
+	bad        uint64
+	failed     uint64
+	min        int64
+	max        int64
+	hist       *hdrhistogram.Histogram
+	steadyHist *hdrhistogram.Histogram
+	// The steady counts only include steady state samples, which are the
+	// ones that count toward the run totals.
+	steadyGood   uint64
+	steadyBad    uint64
+	steadyFailed uint64
+}
+
+func newGroupStats(maxValue int64) *groupStats {
+	return &groupStats{
+		min:        math.MaxInt64,
+		hist:       hdrhistogram.New(0, maxValue, 3),
+		steadyHist: hdrhistogram.New(0, maxValue, 3),
+	}
+}
+
+func (s *groupStats) record(success bool, failed bool, latency int64, steady bool) {
+	if failed {
+		s.failed++
+		if steady {
+			s.steadyFailed++
+		}
+		return
+	}
+	if success {
+		s.good++
+		if steady {
+			s.steadyGood++
+		}
+	} else {
+		s.bad++
+		if steady {
+			s.steadyBad++
+		}
+	}
+	if latency < s.min {
+		s.min = latency
+	}
+	if latency > s.max {
+		s.max = latency
+	}
+	s.hist.RecordValue(latency)
+	if steady {
+		s.steadyHist.RecordValue(latency)
+	}
+}
+
+// merge adds everything recorded in other to s.
+func (s *groupStats) merge(other *groupStats) {
+	s.good += other.good
+	s.bad += other.bad
+	s.failed += other.failed
+	s.steadyGood += other.steadyGood
+	s.steadyBad += other.steadyBad
+	s.steadyFailed += other.steadyFailed
+	if other.min < s.min {
+		s.min = other.min
+	}
+	if other.max > s.max {
+		s.max = other.max
+	}
+	s.hist.Merge(other.hist)
+	s.steadyHist.Merge(other.steadyHist)
+}
+
+// reset clears s for the next interval.
+func (s *groupStats) reset() {
+	s.good = 0
+	s.bad = 0
+	s.failed = 0
+	s.steadyGood = 0
+	s.steadyBad = 0
+	s.steadyFailed = 0
+	s.min = math.MaxInt64
+	s.max = 0
+	s.hist.Reset()
+	s.steadyHist.Reset()
+}
+
+// groupTotals are the steady state results of a group of urls over the
+// run.
+type groupTotals struct {
+	good   uint64
+	bad    uint64
+	failed uint64
+	hist   *hdrhistogram.Histogram
+}
+
+// urlTable breaks down results by groups of urls. A url's group is picked
+// by its grouping.
+type urlTable struct {
+	grouping func(*url.URL) string
+	maxValue int64
+	// byURL maps urls to their groups, so that request threads only look
+	// up a url's group once, without locking.
+	byURL sync.Map
+
+	sync.Mutex
+	byKey map[string]*urlGroup
+	// totals are only added to at the end of each interval.
+	totals map[*urlGroup]*groupTotals
+}
+
+// newURLTable returns a urlTable grouping urls by spec, which is either
+// "url" to group by the whole url, "path" to group by path, or a regular
+// expression whose matches in the path are replaced by * to form a group,
+// so that [0-9]+ puts /users/1 and /users/2 in /users/*.
+func newURLTable(spec string, maxValue int64) (*urlTable, error) {
+	var grouping func(*url.URL) string
+	switch spec {
+	case "url":
+		grouping = func(u *url.URL) string { return u.String() }
+	case "path":
+		grouping = func(u *url.URL) string { return u.Path }
+	default:
+		re, err := regexp.Compile(spec)
+		if err != nil {
+			return nil, err
+		}
+		grouping = func(u *url.URL) string { return re.ReplaceAllString(u.Path, "*") }
+	}
+	return &urlTable{
+		grouping: grouping,
+		maxValue: maxValue,
+		byKey:    make(map[string]*urlGroup),
+		totals:   make(map[*urlGroup]*groupTotals),
+	}, nil
+}
+
+// lookup returns the group u is in.
+func (t *urlTable) lookup(u *url.URL) *urlGroup {
+	if g, ok := t.byURL.Load(u); ok {
+		return g.(*urlGroup)
+	}
+
+	key := t.grouping(u)
+	t.Lock()
+	defer t.Unlock()
+	g, ok := t.byKey[key]
+	if !ok {
+		g = &urlGroup{key: key, metrics: newURLMetrics(key)}
+		t.byKey[key] = g
+		t.totals[g] = &groupTotals{hist: hdrhistogram.New(0, t.maxValue, 3)}
+	}
+	t.byURL.Store(u, g)
+	return g
+}
+
+// sorted returns every group ordered by key, with its run totals.
+func (t *urlTable) sorted() ([]*urlGroup, []*groupTotals) {
+	t.Lock()
+	defer t.Unlock()
+	groups := make([]*urlGroup, 0, len(t.byKey))
+	for _, g := range t.byKey {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].key < groups[j].key })
+	totals := make([]*groupTotals, len(groups))
+	for i, g := range groups {
+		totals[i] = t.totals[g]
+	}
+	return groups, totals
+}
+
+// keyWidth is how wide the widest group key is.
+func keyWidth(groups []*urlGroup) int {
+	width := len("url")
+	for _, g := range groups {
+		if len(g.key) > width {
+			width = len(g.key)
+		}
+	}
+	return width
+}
+
+// printInterval writes a line for every group about the interval stats
+// were collected over, and adds its steady state results to the totals.
+func (t *urlTable) printInterval(w io.Writer, stats *intervalStats) {
+	groups, totals := t.sorted()
+	width := keyWidth(groups)
+	empty := newGroupStats(t.maxValue)
+	for i, g := range groups {
+		s, ok := stats.groups[g]
+		if !ok {
+			s = empty
+		}
+		min := s.min
+		if min == math.MaxInt64 {
+			min = 0
+		}
+		fmt.Fprintf(w, "# %-*s %6d/%1d/%1d %3d [%3d %3d %3d %4d ] %4d\n",
+			width,
+			g.key,
+			s.good,
+			s.bad,
+			s.failed,
+			min,
+			s.hist.ValueAtQuantile(50),
+			s.hist.ValueAtQuantile(95),
+			s.hist.ValueAtQuantile(99),
+			s.hist.ValueAtQuantile(999),
+			s.max)
+		totals[i].good += s.steadyGood
+		totals[i].bad += s.steadyBad
+		totals[i].failed += s.steadyFailed
+		totals[i].hist.Merge(s.steadyHist)
+	}
+}
+
+// printSummary writes a table of the latency of every group over the run.
+func (t *urlTable) printSummary(w io.Writer, latencyUnit string) {
+	groups, totals := t.sorted()
+	width := keyWidth(groups)
+	fmt.Fprintf(w, "# %-*s   good/b/f  p50  p95  p99 p999  max (%s)\n", width, "url", latencyUnit)
+	for i, g := range groups {
+		s := totals[i]
+		fmt.Fprintf(w, "# %-*s %6d/%1d/%1d %4d %4d %4d %4d %4d\n",
+			width,
+			g.key,
+			s.good,
+			s.bad,
+			s.failed,
+			s.hist.ValueAtQuantile(50),
+			s.hist.ValueAtQuantile(95),
+			s.hist.ValueAtQuantile(99),
+			s.hist.ValueAtQuantile(999),
+			s.hist.Max())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLGrouping(t *testing.T) {
+	first, _ := url.Parse("http://localhost:4140/users/1?debug=true")
+	second, _ := url.Parse("http://localhost:4140/users/22")
+	for spec, expected := range map[string][]string{
+		"url":    {"http://localhost:4140/users/1?debug=true", "http://localhost:4140/users/22"},
+		"path":   {"/users/1", "/users/22"},
+		"[0-9]+": {"/users/*", "/users/*"},
+	} {
+		table, err := newURLTable(spec, int64(time.Hour/time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := table.lookup(first).key; key != expected[0] {
+			t.Errorf("Expected %s to group %s as %s, instead got %s", spec, first, expected[0], key)
+		}
+		if key := table.lookup(second).key; key != expected[1] {
+			t.Errorf("Expected %s to group %s as %s, instead got %s", spec, second, expected[1], key)
+		}
+	}
+	if _, err := newURLTable("[", 1000); err == nil {
+		t.Errorf("Expected an error for an invalid regexp")
+	}
+}
+
+func TestURLTable(t *testing.T) {
+	table, _ := newURLTable("path", int64(time.Hour/time.Millisecond))
+	fast, _ := url.Parse("http://localhost:4140/fast")
+	slow, _ := url.Parse("http://localhost:4140/slow")
+	newStats := func() *intervalStats {
+		return newIntervalStats(int64(time.Hour/time.Millisecond), false, false, false)
+	}
+	// Results recorded in different shards are merged by group.
+	rec := newRecorder(4, newStats, time.Millisecond)
+	for i := uint64(0); i < 10; i++ {
+		rec.record(i, &MeasuredResponse{code: 200, good: true, latency: time.Millisecond, group: table.lookup(fast)})
+		rec.record(i, &MeasuredResponse{code: 200, good: true, latency: 100 * time.Millisecond, group: table.lookup(slow)})
+	}
+	rec.record(1, &MeasuredResponse{code: 500, latency: 200 * time.Millisecond, group: table.lookup(slow)})
+	rec.record(2, &MeasuredResponse{err: errors.New("reset"), errClass: errReset, group: table.lookup(slow)})
+	stats := newStats()
+	rec.collect(stats)
+
+	var interval bytes.Buffer
+	table.printInterval(&interval, stats)
+	lines := strings.Split(strings.TrimSpace(interval.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "/fast") || !strings.Contains(lines[1], "/slow") {
+		t.Fatalf("Expected a line for /fast and then /slow, instead got:\n%s", interval.String())
+	}
+	if !strings.Contains(lines[1], "10/1/1") || !strings.HasSuffix(lines[1], " 200") {
+		t.Errorf("Expected /slow to have 10/1/1 results and a max of 200, instead got %s", lines[1])
+	}
+
+	// The run totals carry on from interval to interval.
+	groups, totals := table.sorted()
+	if groups[1] != table.lookup(slow) {
+		t.Fatalf("Expected /slow to sort after /fast")
+	}
+	s := totals[1]
+	if s.good != 10 || s.bad != 1 || s.failed != 1 || s.hist.TotalCount() != 11 {
+		t.Errorf("Expected run totals of 10/1/1 and 11 samples, instead got %d/%d/%d and %d",
+			s.good, s.bad, s.failed, s.hist.TotalCount())
+	}
+
+	// Samples outside of steady state only count toward the interval.
+	stats.reset()
+	stats.group(table.lookup(fast)).record(true, false, 5, false)
+	interval.Reset()
+	table.printInterval(&interval, stats)
+	if !strings.Contains(interval.String(), "1/0/0") || totals[0].good != 10 {
+		t.Errorf("Expected a warmup sample to only count toward the interval, instead got %d good in total", totals[0].good)
+	}
+}